@@ -6,19 +6,65 @@ package silence
 // TODO(tlim):  This should be part of Bosun.
 
 import (
-	"bytes"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
 	"os/user"
+	"path"
+	"regexp"
+	"sort"
 	"strings"
 	"time"
 )
 
+// DefaultHost is the Bosun server used when SetSilence is given no host.
+// It may be a bare host name, which is contacted over https, or a base URL
+// such as "http://localhost:8070".
+var DefaultHost = "bosun"
+
+// Default is the Silencer used by EasySilence, EasyUnsilence and friends
+// when they aren't given a Bosun host.
+var Default Silencer = &Bosun{}
+
+// ErrNotSupported is returned by Silencers that can't do what was asked.
+var ErrNotSupported = errors.New("not supported by this silencer")
+
+// Geteuid is how SudoUser tells whether this process runs as root. Tests
+// may replace it to pretend otherwise.
+var Geteuid = os.Geteuid
+
+// Silencer is a monitoring system that can silence alerts.
+type Silencer interface {
+	// Request returns the HTTP request that Set would send for s.
+	Request(s *SilenceRequest) (*http.Request, error)
+	// Set creates the silence, filling in s.ID if the monitoring system
+	// tells us what it is.
+	Set(s *SilenceRequest) error
+	// Clear removes the silence with the given ID.
+	Clear(id string) error
+	// Find returns the IDs of the active silences of alert with exactly
+	// the given tags.
+	Find(alert, tags string) ([]string, error)
+	// List returns the active and pending silences that cover the given
+	// tags, e.g. "host=web01" finds silences on "host=web*|db01".
+	List(tags string) ([]*Silence, error)
+}
+
+// Silence is an existing silence.
+type Silence struct {
+	ID        string `json:"-"`
+	Start     time.Time
+	End       time.Time
+	Alert     string
+	TagString string
+	Forget    bool
+	User      string
+	Message   string
+}
+
 type SilenceRequest struct {
 	User    string `json:"user"`
 	Start   string `json:"start"`
@@ -28,96 +74,373 @@ type SilenceRequest struct {
 	Message string `json:"message"`
 	Confirm string `json:"confirm"`
 	Forget  string `json:"forget"`
+	// Edit is the ID of an existing silence that this one replaces.
+	Edit string `json:"edit,omitempty"`
+
+	// ID is filled in by SetSilence once the silence has been created.
+	ID string `json:"-"`
 }
 
-// EasySilence inserts a Bosun silence with some reasonable defaults.
+const timeFormat = "2006-01-02 15:04:05 MST"
+
+// EasySilence inserts a silence with some reasonable defaults.
 func EasySilence(alert, duration, message string, hosts []string) (string, error) {
-	if len(hosts) == 0 {
-		// Add our own hostname (the shortname).
-		// (If you want the long name, file a PR.)
-		h, err := os.Hostname()
-		if err == nil {
-			h = strings.SplitN(h, ".", 2)[0]
-			hosts = append(hosts, h)
-		}
+	s, err := NewSilenceRequest(alert, duration, message, HostTags(hosts))
+	if err != nil {
+		return "DURATION ERROR", err
 	}
+	return SetSilence("", s)
+}
 
+// NewSilenceRequest builds the request EasySilence sends, so that callers
+// can hold on to it (and the ID SetSilence fills in). See ParseEnd for the
+// durations it understands, and MakeTags for building tags. Empty tags
+// mean this host.
+func NewSilenceRequest(alert, duration, message, tags string) (*SilenceRequest, error) {
 	now := time.Now().UTC()
-	d, err := time.ParseDuration(duration)
+	end, err := ParseEnd(duration, now)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	end := now.Add(d)
 
-	s := &SilenceRequest{
-		Start:   now.Format("2006-01-02 15:04:05 MST"),
-		End:     end.Format("2006-01-02 15:04:05 MST"),
-		Tags:    "host=" + strings.Join(hosts, "|"),
+	return &SilenceRequest{
+		Start:   now.Format(timeFormat),
+		End:     end.Format(timeFormat),
+		Tags:    defaultTags(tags),
 		Alert:   alert,
 		Message: message,
 		Confirm: "confirm",
+	}, nil
+}
+
+// EasyUnsilence clears the silences with the given IDs. If there are none,
+// it clears every active silence of alert with exactly the given tags
+// (empty meaning this host) instead. Returns a summary string of what was
+// done.
+func EasyUnsilence(alert string, ids []string, tags string) (string, error) {
+	if len(ids) == 0 {
+		found, err := FindSilences("", alert, defaultTags(tags))
+		if err == ErrNotSupported {
+			return "No silence IDs were recorded and this silencer can't look them up", nil
+		}
+		if err != nil {
+			return "FIND ERROR", err
+		}
+		ids = found
 	}
-	return SetSilence("", s)
+	if len(ids) == 0 {
+		return "No silences to clear", nil
+	}
+	for _, id := range ids {
+		if err := ClearSilence("", id); err != nil {
+			return "CLEAR ERROR", err
+		}
+	}
+	return fmt.Sprintf("Cleared silences: %s", strings.Join(ids, ", ")), nil
 }
 
-// SetSilence inserts a Bosun silence, filling in some reasonable defaults
+// HostTags returns the tags that match hosts, defaulting to our own hostname.
+func HostTags(hosts []string) string {
+	if len(hosts) == 0 {
+		hosts = append(hosts, LocalHost(false))
+	}
+	return "host=" + strings.Join(hosts, "|")
+}
+
+func defaultTags(tags string) string {
+	if tags == "" {
+		return HostTags(nil)
+	}
+	return tags
+}
+
+// LocalHost returns our own hostname: the shortname, or if fqdn is set,
+// the fully qualified name (as best we can tell).
+func LocalHost(fqdn bool) string {
+	h, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	if !fqdn {
+		return strings.SplitN(h, ".", 2)[0]
+	}
+	if strings.Contains(h, ".") {
+		return h
+	}
+	if cname, err := net.LookupCNAME(h); err == nil && strings.Contains(strings.TrimSuffix(cname, "."), ".") {
+		return strings.TrimSuffix(cname, ".")
+	}
+	return h
+}
+
+// tagRegexp matches what OpenTSDB, and so Bosun, allows in tag keys and
+// values, plus * wildcards. The tag syntax has no escapes, so anything
+// else (notably ",", "=" and "|") can't be silenced on.
+var tagRegexp = regexp.MustCompile(`^[\p{L}\p{N}\-_./*]+$`)
+
+// MakeTags builds Bosun's tag syntax ("host=a|b,role=web") from hosts,
+// defaulting to our own hostname, and extra "key=value" tags. Several
+// values for the same key become alternatives. Keys are sorted, as
+// Bosun does, so that the result can be compared with existing silences.
+func MakeTags(hosts []string, extra []string) (string, error) {
+	if len(hosts) == 0 {
+		hosts = append(hosts, LocalHost(false))
+	}
+	tags := map[string][]string{"host": hosts}
+	for _, tag := range extra {
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 {
+			return "", fmt.Errorf("tag %q should look like key=value", tag)
+		}
+		tags[kv[0]] = append(tags[kv[0]], kv[1])
+	}
+	var keys []string
+	for k, values := range tags {
+		if !tagRegexp.MatchString(k) || strings.Contains(k, "*") {
+			return "", fmt.Errorf("bad tag key %q", k)
+		}
+		for _, v := range values {
+			if !tagRegexp.MatchString(v) {
+				return "", fmt.Errorf("bad value %q for tag %s: only letters, numbers, -, _, ., / and * are allowed", v, k)
+			}
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = k + "=" + strings.Join(tags[k], "|")
+	}
+	return strings.Join(parts, ","), nil
+}
+
+// silencer returns the Bosun at bosunhost, or Default if bosunhost is empty.
+func silencer(bosunhost string) Silencer {
+	if bosunhost == "" {
+		return Default
+	}
+	return &Bosun{Host: bosunhost}
+}
+
+// SetSilence inserts a silence into the Bosun at bosunhost (or the Default
+// silencer if bosunhost is empty), filling in some reasonable defaults
 // if needed. Returns a summary string of what was done.
 func SetSilence(bosunhost string, s *SilenceRequest) (string, error) {
+	if err := fillDefaults(s); err != nil {
+		return "ERROR: Not running on an OS that supports usernames", err
+	}
+	if err := silencer(bosunhost).Set(s); err != nil {
+		return "SET ERROR", err
+	}
+	return Summary(s), nil
+}
 
-	if bosunhost == "" {
-		bosunhost = "bosun"
+// DryRunSilence fills in the defaults of s as SetSilence would, and
+// describes the request it would send to the Bosun at bosunhost (or the
+// Default silencer if bosunhost is empty) without sending it.
+func DryRunSilence(bosunhost string, s *SilenceRequest) (string, error) {
+	if err := fillDefaults(s); err != nil {
+		return "ERROR: Not running on an OS that supports usernames", err
 	}
+	req, err := silencer(bosunhost).Request(s)
+	if err != nil {
+		return "REQUEST ERROR", err
+	}
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "ERROR ReadAll", err
+	}
+	start, _ := time.Parse(timeFormat, s.Start)
+	end, _ := time.Parse(timeFormat, s.End)
+	return fmt.Sprintf("Dry run, not setting silence: Start: %s, End: %s (%v)\n%s %s\n%s\n",
+		start.Local().Format(time.RFC1123), end.Local().Format(time.RFC1123), end.Sub(start), req.Method, req.URL, body), nil
+}
+
+// ClearSilence removes the silence with the given ID.
+func ClearSilence(bosunhost, id string) error {
+	return silencer(bosunhost).Clear(id)
+}
+
+// FindSilences returns the IDs of the active silences of alert with exactly the given tags.
+func FindSilences(bosunhost, alert, tags string) ([]string, error) {
+	return silencer(bosunhost).Find(alert, tags)
+}
+
+// ListSilences returns the active and pending silences that cover tags.
+func ListSilences(tags string) ([]*Silence, error) {
+	silences, err := Default.List(tags)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(silences, func(i, j int) bool { return silences[i].End.Before(silences[j].End) })
+	return silences, nil
+}
 
+// ExtendSilence replaces s with a silence that ends at end, and updates s
+// to match the replacement. Returns a summary string of what was done.
+func ExtendSilence(s *Silence, end time.Time) (string, error) {
+	req := &SilenceRequest{
+		Start:   s.Start.UTC().Format(timeFormat),
+		End:     end.UTC().Format(timeFormat),
+		Tags:    s.TagString,
+		Alert:   s.Alert,
+		Message: s.Message,
+		Confirm: "confirm",
+		Edit:    s.ID,
+	}
+	if s.Forget {
+		req.Forget = "true"
+	}
+	summary, err := SetSilence("", req)
+	if err != nil {
+		return summary, err
+	}
+	s.ID, s.End, s.User = req.ID, end, req.User
+	return summary, nil
+}
+
+// Summary describes the silence s for humans.
+func Summary(s *SilenceRequest) string {
+	alert, tags, message := s.Alert, s.Tags, s.Message
+	if alert == "" {
+		alert = "None"
+	}
+	if tags == "" {
+		tags = "None"
+	}
+	if message == "" {
+		message = "None"
+	}
+	return fmt.Sprintf("Created silence: Start: %s, End: %s, Tags: %s, Alert: %s, Message: %s\n", s.Start, s.End, tags, alert, message)
+}
+
+// fillDefaults sets the user and start time of s if they are missing.
+func fillDefaults(s *SilenceRequest) error {
 	if s.User == "" {
-		u, err := user.Current()
+		username, err := RealUser()
 		if err != nil {
-			return "ERROR: Not running on an OS that supports usernames", err
-		}
-		username := u.Username
-		userParts := strings.Split(username, "\\")
-		if len(userParts) > 1 {
-			username = userParts[1]
-		}
-		sudo := os.Getenv("SUDO_USER")
-		if sudo != "" {
-			username = sudo
+			return err
 		}
 		s.User = username
 	}
 
 	if s.Start == "" {
-		s.Start = time.Now().UTC().Format("2006-01-02 15:04:05 MST")
+		s.Start = time.Now().UTC().Format(timeFormat)
 	}
+	return nil
+}
 
-	b, err := json.Marshal(s)
+// LoginUser returns the name of the user running this process, without any
+// Windows domain.
+func LoginUser() (string, error) {
+	u, err := user.Current()
 	if err != nil {
-		return fmt.Sprintf("Marshal failed: %#v", s), err
+		return "", err
+	}
+	userParts := strings.Split(u.Username, "\\")
+	return userParts[len(userParts)-1], nil
+}
+
+// RealUser returns who is behind this process: whoever ran sudo, if it was
+// run with sudo, otherwise LoginUser.
+func RealUser() (string, error) {
+	if sudo := SudoUser(); sudo != "" {
+		return sudo, nil
+	}
+	return LoginUser()
+}
+
+// SudoUser returns whoever ran sudo to run this process, or "" if it wasn't
+// run with sudo. $SUDO_USER is only believed when running as root, which is
+// what sudo runs things as: anyone can set it, and anyone but root could be
+// pretending to be someone else.
+func SudoUser() string {
+	if Geteuid() != 0 {
+		return ""
 	}
-	u := url.URL{
-		Scheme: "https",
-		Host:   bosunhost,
-		Path:   "/api/silence/set",
+	return os.Getenv("SUDO_USER")
+}
+
+// do sends req with client, returning the body of a successful response.
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	if client == nil {
+		client = http.DefaultClient
 	}
-	resp, err := http.Post(u.String(), "application/json", bytes.NewBuffer(b))
+	resp, err := client.Do(req)
 	if err != nil {
-		return "POST ERROR", err
+		return nil, err
 	}
 	c, err := ioutil.ReadAll(resp.Body)
 	defer resp.Body.Close()
 	if err != nil {
-		return "ERROR ReadAll", err
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(c)))
+	}
+	return c, nil
+}
+
+// parseTags splits Bosun-style tags ("host=a|b,role=web") into a map of
+// alternatives.
+func parseTags(tags string) (map[string][]string, error) {
+	parsed := map[string][]string{}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad tag %q in %q", tag, tags)
+		}
+		parsed[kv[0]] = strings.Split(kv[1], "|")
 	}
-	if resp.StatusCode != 200 {
-		return "STATUS", fmt.Errorf("%s", c)
+	return parsed, nil
+}
+
+// covers reports whether a silence on tags covers everything in want. Each
+// tag in want must be present, and match one of its alternatives, which may
+// contain * wildcards.
+func covers(tags string, want map[string][]string) bool {
+	have, err := parseTags(tags)
+	if err != nil {
+		return false
+	}
+	for k, values := range want {
+		for _, v := range values {
+			if !matchesAny(have[k], v) {
+				return false
+			}
+		}
 	}
-	if s.Alert == "" {
-		s.Alert = "None"
+	return true
+}
+
+// OnlyHosts reports whether a silence on tags is on some of hosts and
+// nothing else: one host tag, whose names are all in hosts. Wildcards,
+// other hosts and other tags make a silence wider than that.
+func OnlyHosts(tags string, hosts []string) bool {
+	have, err := parseTags(tags)
+	if err != nil || len(have) != 1 || len(have["host"]) == 0 {
+		return false
 	}
-	if s.Tags == "" {
-		s.Tags = "None"
+	for _, name := range have["host"] {
+		found := false
+		for _, h := range hosts {
+			found = found || name == h
+		}
+		if !found {
+			return false
+		}
 	}
-	if s.Message == "" {
-		s.Message = "None"
+	return true
+}
+
+func matchesAny(patterns []string, v string) bool {
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, v); ok {
+			return true
+		}
 	}
-	return fmt.Sprintf("Created silence: Start: %s, End: %s, Tags: %s, Alert: %s, Message: %s\n", s.Start, s.End, s.Tags, s.Alert, s.Message), nil
+	return false
 }
@@ -0,0 +1,303 @@
+package silence
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeBosun is a stand-in for the parts of Bosun's silence API we use.
+type fakeBosun struct {
+	silences map[string]*Silence
+	requests []SilenceRequest
+	cleared  []string
+	t        *testing.T
+}
+
+func newFakeBosun(t *testing.T) (*fakeBosun, *httptest.Server) {
+	f := &fakeBosun{silences: map[string]*Silence{}, t: t}
+	return f, httptest.NewServer(f)
+}
+
+func (f *fakeBosun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/silence/set":
+		var s SilenceRequest
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			f.t.Error(err)
+		}
+		f.requests = append(f.requests, s)
+		start, _ := time.Parse(timeFormat, s.Start)
+		end, _ := time.Parse(timeFormat, s.End)
+		f.silences[fmt.Sprintf("id%d", len(f.requests))] = &Silence{
+			Start: start, End: end, Alert: s.Alert, TagString: s.Tags, User: s.User, Message: s.Message,
+		}
+	case "/api/silence/get":
+		json.NewEncoder(w).Encode(f.silences)
+	case "/api/silence/clear":
+		id := r.FormValue("id")
+		delete(f.silences, id)
+		f.cleared = append(f.cleared, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestEasySilence(t *testing.T) {
+	f, ts := newFakeBosun(t)
+	defer ts.Close()
+
+	defer func(h string) { DefaultHost = h }(DefaultHost)
+	DefaultHost = ts.URL
+
+	summary, err := EasySilence("puppet.left.disabled", "2h", "testing", []string{"web01", "web02"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(summary, "Created silence:") {
+		t.Errorf("unexpected summary %q", summary)
+	}
+	if len(f.requests) != 1 {
+		t.Fatalf("expected 1 request, got %d", len(f.requests))
+	}
+	got := f.requests[0]
+	if got.Alert != "puppet.left.disabled" || got.Message != "testing" || got.Confirm != "confirm" {
+		t.Errorf("unexpected request %+v", got)
+	}
+	if got.Tags != "host=web01|web02" {
+		t.Errorf("expected tags (host=web01|web02) got (%v)", got.Tags)
+	}
+	if got.User == "" || got.Start == "" || got.End == "" {
+		t.Errorf("defaults not filled in: %+v", got)
+	}
+}
+
+func TestSetSilenceFindsID(t *testing.T) {
+	f, ts := newFakeBosun(t)
+	defer ts.Close()
+
+	// Another silence that must not be mistaken for ours.
+	f.silences["other"] = &Silence{Alert: "puppet.left.disabled", TagString: "host=web01", User: "someone"}
+
+	s, err := NewSilenceRequest("puppet.left.disabled", "1h", "testing", "host=web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.User = "tester"
+	if _, err := SetSilence(ts.URL, s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != "id1" {
+		t.Errorf("expected ID (id1) got (%v)", s.ID)
+	}
+}
+
+func TestEasyUnsilence(t *testing.T) {
+	f, ts := newFakeBosun(t)
+	defer ts.Close()
+
+	defer func(h string) { DefaultHost = h }(DefaultHost)
+	DefaultHost = ts.URL
+
+	f.silences["a"] = &Silence{Alert: "puppet.left.disabled", TagString: "host=web01"}
+	f.silences["b"] = &Silence{Alert: "puppet.left.disabled", TagString: "host=web02"}
+	f.silences["c"] = &Silence{Alert: "other.alert", TagString: "host=web01"}
+	f.silences["d"] = &Silence{Alert: "puppet.left.disabled", TagString: "host=web01"}
+
+	// Known IDs are cleared directly.
+	if _, err := EasyUnsilence("puppet.left.disabled", []string{"b"}, "host=web01"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.cleared, ",") != "b" {
+		t.Errorf("expected (b) to be cleared, got (%v)", f.cleared)
+	}
+
+	// Otherwise we look for the host's silences of that alert.
+	f.cleared = nil
+	if _, err := EasyUnsilence("puppet.left.disabled", nil, "host=web01"); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(f.cleared, ",") != "a,d" {
+		t.Errorf("expected (a,d) to be cleared, got (%v)", f.cleared)
+	}
+}
+
+func TestSetSilenceError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "bad silence", http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	_, err := SetSilence(ts.URL, &SilenceRequest{Alert: "x", User: "tester"})
+	if err == nil || !strings.Contains(err.Error(), "bad silence") {
+		t.Errorf("expected Bosun's error, got %v", err)
+	}
+}
+
+func TestBosunURL(t *testing.T) {
+	tests := []struct {
+		host string
+		e1   string
+	}{
+		{"bosun", "https://bosun/api/silence/set"},
+		{"bosun.example.com:8070", "https://bosun.example.com:8070/api/silence/set"},
+		{"http://localhost:8070", "http://localhost:8070/api/silence/set"},
+		{"https://mon.example.com/bosun/", "https://mon.example.com/bosun/api/silence/set"},
+	}
+	for i, test := range tests {
+		u, err := bosunURL(test.host, "/api/silence/set")
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if u.String() != test.e1 {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.e1, u)
+		}
+	}
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		tags string
+		want string
+		e1   bool
+	}{
+		{"host=web01", "host=web01", true},
+		{"host=web01|web02", "host=web02", true},
+		{"host=web*", "host=web02", true},
+		{"host=db*", "host=web02", false},
+		{"host=web01,role=web", "host=web01", true},
+		{"role=web", "host=web01", false},
+		{"host=web01", "host=web01,role=web", false},
+	}
+	for i, test := range tests {
+		want, err := parseTags(test.want)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if got := covers(test.tags, want); got != test.e1 {
+			t.Errorf("%v: covers(%q, %q): expected (%v) got (%v)", i, test.tags, test.want, test.e1, got)
+		}
+	}
+}
+
+func TestOnlyHosts(t *testing.T) {
+	hosts := []string{"web01", "web01.example.com"}
+	tests := []struct {
+		tags string
+		e1   bool
+	}{
+		{"host=web01", true},
+		{"host=web01|web01.example.com", true},
+		{"host=web0*", false},
+		{"host=web01|db01", false},
+		{"host=web01,role=web", false},
+		{"role=web", false},
+		{"host=", false},
+	}
+	for i, test := range tests {
+		if got := OnlyHosts(test.tags, hosts); got != test.e1 {
+			t.Errorf("%v: OnlyHosts(%q): expected (%v) got (%v)", i, test.tags, test.e1, got)
+		}
+	}
+}
+
+func TestMakeTags(t *testing.T) {
+	tests := []struct {
+		hosts []string
+		extra []string
+		e1    string
+	}{
+		{[]string{"web01"}, nil, "host=web01"},
+		{[]string{"web01", "web01.example.com"}, nil, "host=web01|web01.example.com"},
+		{[]string{"web01"}, []string{"role=web", "cluster=ny-*"}, "cluster=ny-*,host=web01,role=web"},
+		{[]string{"web01"}, []string{"role=web", "role=api"}, "host=web01,role=web|api"},
+		{[]string{"web01"}, []string{"host=web01-alias"}, "host=web01|web01-alias"},
+	}
+	for i, test := range tests {
+		got, err := MakeTags(test.hosts, test.extra)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if got != test.e1 {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.e1, got)
+		}
+	}
+
+	bad := []struct {
+		hosts []string
+		extra []string
+	}{
+		{[]string{"web01,role=db"}, nil},
+		{[]string{"web01|db01"}, nil},
+		{[]string{"web01"}, []string{"role"}},
+		{[]string{"web01"}, []string{"role=web=db"}},
+		{[]string{"web01"}, []string{"ro*le=web"}},
+		{[]string{"web01"}, []string{"role=web server"}},
+		{[]string{"web01"}, []string{"=web"}},
+	}
+	for i, test := range bad {
+		if got, err := MakeTags(test.hosts, test.extra); err == nil {
+			t.Errorf("%v: expected an error, got (%v)", i, got)
+		}
+	}
+}
+
+func TestDryRunSilence(t *testing.T) {
+	f, ts := newFakeBosun(t)
+	defer ts.Close()
+
+	s, err := NewSilenceRequest("puppet.left.disabled", "90m", "testing", "host=web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := DryRunSilence(ts.URL, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.requests) != 0 {
+		t.Errorf("dry run sent %v", f.requests)
+	}
+	body, _ := json.Marshal(s)
+	for _, want := range []string{"POST " + ts.URL + "/api/silence/set", string(body), "(1h30m0s)"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("dry run output lacks %q:\n%s", want, got)
+		}
+	}
+	if s.User == "" {
+		t.Error("dry run didn't fill in the user")
+	}
+}
+
+func TestSudoUser(t *testing.T) {
+	defer func(f func() int) { Geteuid = f }(Geteuid)
+	defer os.Setenv("SUDO_USER", os.Getenv("SUDO_USER"))
+	login, err := LoginUser()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		euid     int
+		sudoUser string
+		e1       string
+	}{
+		{0, "alice", "alice"},
+		{0, "", login},
+		// Only root can have been run by sudo
+		{1000, "alice", login},
+		{-1, "alice", login},
+	}
+	for i, test := range tests {
+		Geteuid = func() int { return test.euid }
+		os.Setenv("SUDO_USER", test.sudoUser)
+		if got, _ := RealUser(); got != test.e1 {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.e1, got)
+		}
+	}
+}
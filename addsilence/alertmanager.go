@@ -0,0 +1,284 @@
+package silence
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Alertmanager silences alerts through Prometheus Alertmanager's v2 API.
+// The alert becomes an "alertname" matcher and each tag a label matcher.
+type Alertmanager struct {
+	// URL is the base URL of the Alertmanager, e.g. "http://alertmanager:9093".
+	URL string
+	// Client is used for all requests. Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+type amMatcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+}
+
+type amSilence struct {
+	ID        string      `json:"id,omitempty"`
+	Matchers  []amMatcher `json:"matchers"`
+	StartsAt  time.Time   `json:"startsAt"`
+	EndsAt    time.Time   `json:"endsAt"`
+	CreatedBy string      `json:"createdBy"`
+	Comment   string      `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+// Request returns a POST of s, in Alertmanager's form, to /api/v2/silences.
+func (a *Alertmanager) Request(s *SilenceRequest) (*http.Request, error) {
+	as, err := a.silence(s)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(as)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", a.url("/api/v2/silences"), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// Set POSTs s to /api/v2/silences.
+func (a *Alertmanager) Set(s *SilenceRequest) error {
+	req, err := a.Request(s)
+	if err != nil {
+		return err
+	}
+	c, err := do(a.Client, req)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		SilenceID string `json:"silenceID"`
+	}
+	if err := json.Unmarshal(c, &resp); err != nil {
+		return err
+	}
+	s.ID = resp.SilenceID
+	return nil
+}
+
+// Clear DELETEs /api/v2/silence/<id>.
+func (a *Alertmanager) Clear(id string) error {
+	req, err := http.NewRequest("DELETE", a.url("/api/v2/silence/"+url.PathEscape(id)), nil)
+	if err != nil {
+		return err
+	}
+	_, err = do(a.Client, req)
+	return err
+}
+
+// Find looks through /api/v2/silences for unexpired silences with exactly
+// the matchers that Set would have used.
+func (a *Alertmanager) Find(alert, tags string) ([]string, error) {
+	want, err := amMatchers(alert, tags)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", a.url("/api/v2/silences"), nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := do(a.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	var silences []amSilence
+	if err := json.Unmarshal(c, &silences); err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, s := range silences {
+		if s.Status != nil && s.Status.State == "expired" {
+			continue
+		}
+		if sameMatchers(s.Matchers, want) {
+			ids = append(ids, s.ID)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// List looks through /api/v2/silences for unexpired silences whose matchers
+// match all of tags.
+func (a *Alertmanager) List(tags string) ([]*Silence, error) {
+	want, err := parseTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", a.url("/api/v2/silences"), nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := do(a.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	var silences []amSilence
+	if err := json.Unmarshal(c, &silences); err != nil {
+		return nil, err
+	}
+	var found []*Silence
+	for _, s := range silences {
+		if s.Status != nil && s.Status.State == "expired" {
+			continue
+		}
+		if amCovers(s.Matchers, want) {
+			found = append(found, s.toSilence())
+		}
+	}
+	return found, nil
+}
+
+// toSilence converts an Alertmanager silence back into our form, undoing
+// what amMatchers does to alternatives and wildcards.
+func (s *amSilence) toSilence() *Silence {
+	silence := &Silence{
+		ID:      s.ID,
+		Start:   s.StartsAt,
+		End:     s.EndsAt,
+		User:    s.CreatedBy,
+		Message: s.Comment,
+	}
+	var tags []string
+	for _, m := range s.Matchers {
+		if m.Name == "alertname" && !m.IsRegex {
+			silence.Alert = m.Value
+			continue
+		}
+		value := m.Value
+		if m.IsRegex {
+			value = unescapeRegexp.ReplaceAllString(strings.Replace(value, ".*", "*", -1), "$1")
+		}
+		tags = append(tags, m.Name+"="+value)
+	}
+	silence.TagString = strings.Join(tags, ",")
+	return silence
+}
+
+var unescapeRegexp = regexp.MustCompile(`\\(.)`)
+
+// amCovers reports whether matchers match every value in want.
+func amCovers(matchers []amMatcher, want map[string][]string) bool {
+	for name, values := range want {
+		for _, v := range values {
+			matched := false
+			for _, m := range matchers {
+				if m.Name != name {
+					continue
+				}
+				if m.IsRegex {
+					matched, _ = regexp.MatchString("^(?:"+m.Value+")$", v)
+				} else {
+					matched = m.Value == v
+				}
+				if matched {
+					break
+				}
+			}
+			if !matched {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (a *Alertmanager) url(path string) string {
+	return strings.TrimSuffix(a.URL, "/") + path
+}
+
+// silence converts s into Alertmanager's form.
+func (a *Alertmanager) silence(s *SilenceRequest) (*amSilence, error) {
+	matchers, err := amMatchers(s.Alert, s.Tags)
+	if err != nil {
+		return nil, err
+	}
+	start, err := time.Parse(timeFormat, s.Start)
+	if err != nil {
+		return nil, err
+	}
+	end, err := time.Parse(timeFormat, s.End)
+	if err != nil {
+		return nil, err
+	}
+	comment := s.Message
+	if comment == "" {
+		// Alertmanager insists on a comment.
+		comment = "None"
+	}
+	return &amSilence{
+		Matchers:  matchers,
+		StartsAt:  start,
+		EndsAt:    end,
+		CreatedBy: s.User,
+		Comment:   comment,
+		// Alertmanager replaces the silence with this ID.
+		ID: s.Edit,
+	}, nil
+}
+
+// amMatchers turns an alert and Bosun-style tags ("host=a|b,role=web*")
+// into Alertmanager matchers, sorted by name. Alternatives and wildcards
+// become anchored regular expressions with everything else escaped.
+func amMatchers(alert, tags string) ([]amMatcher, error) {
+	var matchers []amMatcher
+	if alert != "" {
+		matchers = append(matchers, amMatcher{Name: "alertname", Value: alert})
+	}
+	for _, tag := range strings.Split(tags, ",") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) != 2 || kv[0] == "" || kv[1] == "" {
+			return nil, fmt.Errorf("bad tag %q in %q", tag, tags)
+		}
+		m := amMatcher{Name: kv[0], Value: kv[1]}
+		if strings.ContainsAny(m.Value, "|*") {
+			alternatives := strings.Split(m.Value, "|")
+			for i, v := range alternatives {
+				alternatives[i] = strings.Replace(regexp.QuoteMeta(v), `\*`, ".*", -1)
+			}
+			m.Value = strings.Join(alternatives, "|")
+			m.IsRegex = true
+		}
+		matchers = append(matchers, m)
+	}
+	sort.Slice(matchers, func(i, j int) bool { return matchers[i].Name < matchers[j].Name })
+	return matchers, nil
+}
+
+func sameMatchers(a, b []amMatcher) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]amMatcher(nil), a...)
+	sort.Slice(a, func(i, j int) bool { return a[i].Name < a[j].Name })
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package silence
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAmMatchers(t *testing.T) {
+	tests := []struct {
+		alert string
+		tags  string
+		e1    []amMatcher
+	}{
+		{"puppet.left.disabled", "host=web01", []amMatcher{
+			{Name: "alertname", Value: "puppet.left.disabled"},
+			{Name: "host", Value: "web01"},
+		}},
+		{"", "host=web01|web02.example.com,role=db*", []amMatcher{
+			{Name: "host", Value: `web01|web02\.example\.com`, IsRegex: true},
+			{Name: "role", Value: "db.*", IsRegex: true},
+		}},
+	}
+	for i, test := range tests {
+		got, err := amMatchers(test.alert, test.tags)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, test.e1) {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.e1, got)
+		}
+	}
+	if _, err := amMatchers("x", "host"); err == nil {
+		t.Error("expected an error for a tag without a value")
+	}
+}
+
+func TestAlertmanager(t *testing.T) {
+	var posted amSilence
+	var deleted string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && r.URL.Path == "/api/v2/silences":
+			json.NewDecoder(r.Body).Decode(&posted)
+			w.Write([]byte(`{"silenceID":"abc"}`))
+		case r.Method == "GET" && r.URL.Path == "/api/v2/silences":
+			w.Write([]byte(`[
+				{"id":"abc","status":{"state":"active"},"matchers":[
+					{"name":"host","value":"web01","isRegex":false},
+					{"name":"alertname","value":"puppet.left.disabled","isRegex":false}]},
+				{"id":"old","status":{"state":"expired"},"matchers":[
+					{"name":"alertname","value":"puppet.left.disabled","isRegex":false},
+					{"name":"host","value":"web01","isRegex":false}]},
+				{"id":"other","status":{"state":"active"},"matchers":[
+					{"name":"alertname","value":"puppet.left.disabled","isRegex":false},
+					{"name":"host","value":"web02","isRegex":false}]}]`))
+		case r.Method == "DELETE" && strings.HasPrefix(r.URL.Path, "/api/v2/silence/"):
+			deleted = strings.TrimPrefix(r.URL.Path, "/api/v2/silence/")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	a := &Alertmanager{URL: ts.URL}
+	s, err := NewSilenceRequest("puppet.left.disabled", "1h", "testing", "host=web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.User = "tester"
+	if err := a.Set(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != "abc" {
+		t.Errorf("expected ID (abc) got (%v)", s.ID)
+	}
+	if posted.CreatedBy != "tester" || posted.Comment != "testing" || len(posted.Matchers) != 2 {
+		t.Errorf("unexpected silence %+v", posted)
+	}
+	if posted.EndsAt.Sub(posted.StartsAt).Hours() != 1 {
+		t.Errorf("expected a 1h silence, got %v to %v", posted.StartsAt, posted.EndsAt)
+	}
+
+	ids, err := a.Find("puppet.left.disabled", "host=web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []string{"abc"}) {
+		t.Errorf("expected ([abc]) got (%v)", ids)
+	}
+
+	silences, err := a.List("host=web01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(silences) != 1 || silences[0].ID != "abc" || silences[0].Alert != "puppet.left.disabled" || silences[0].TagString != "host=web01" {
+		t.Errorf("unexpected silences %+v", silences)
+	}
+
+	if err := a.Clear("abc"); err != nil {
+		t.Fatal(err)
+	}
+	if deleted != "abc" {
+		t.Errorf("expected abc to be deleted, got (%v)", deleted)
+	}
+}
+
+func TestAmSilenceRoundTrip(t *testing.T) {
+	for _, tags := range []string{"host=web01", "host=web01|web02.example.com", "host=db*,role=web"} {
+		matchers, err := amMatchers("puppet.left.disabled", tags)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := (&amSilence{Matchers: matchers}).toSilence()
+		if s.Alert != "puppet.left.disabled" || s.TagString != tags {
+			t.Errorf("expected (%v) to survive a round trip, got (%v)", tags, s.TagString)
+		}
+	}
+}
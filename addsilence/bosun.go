@@ -0,0 +1,170 @@
+package silence
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Bosun silences alerts through Bosun's /api/silence endpoints.
+type Bosun struct {
+	// Host is a bare host name, which is contacted over https, or a base
+	// URL. Empty means DefaultHost.
+	Host string
+	// Client is used for all requests. Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// Request returns a POST of s to /api/silence/set.
+func (b *Bosun) Request(s *SilenceRequest) (*http.Request, error) {
+	body, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	u, err := b.url("/api/silence/set")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", u.String(), bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// Set POSTs s to /api/silence/set.
+func (b *Bosun) Set(s *SilenceRequest) error {
+	req, err := b.Request(s)
+	if err != nil {
+		return err
+	}
+	if _, err := do(b.Client, req); err != nil {
+		return err
+	}
+	// Bosun doesn't tell us the ID of the new silence, so go and look for it.
+	// Not finding it is no reason to fail; the silence has been set.
+	if s.Confirm != "" {
+		s.ID = b.findID(s)
+	}
+	return nil
+}
+
+// Clear POSTs the ID to /api/silence/clear.
+func (b *Bosun) Clear(id string) error {
+	u, err := b.url("/api/silence/clear")
+	if err != nil {
+		return err
+	}
+	u.RawQuery = url.Values{"id": {id}}.Encode()
+	req, err := http.NewRequest("POST", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	_, err = do(b.Client, req)
+	return err
+}
+
+// Find looks through /api/silence/get.
+func (b *Bosun) Find(alert, tags string) ([]string, error) {
+	silences, err := b.Get()
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for id, s := range silences {
+		if s.Alert == alert && s.TagString == tags {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// List looks through /api/silence/get.
+func (b *Bosun) List(tags string) ([]*Silence, error) {
+	want, err := parseTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	silences, err := b.Get()
+	if err != nil {
+		return nil, err
+	}
+	var found []*Silence
+	for id, s := range silences {
+		if covers(s.TagString, want) {
+			s.ID = id
+			found = append(found, s)
+		}
+	}
+	return found, nil
+}
+
+// Get returns the active and pending silences known to Bosun, keyed by ID.
+func (b *Bosun) Get() (map[string]*Silence, error) {
+	u, err := b.url("/api/silence/get")
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := do(b.Client, req)
+	if err != nil {
+		return nil, err
+	}
+	silences := map[string]*Silence{}
+	if err := json.Unmarshal(c, &silences); err != nil {
+		return nil, err
+	}
+	return silences, nil
+}
+
+// GetSilences returns the active and pending silences known to the Bosun at
+// bosunhost, keyed by ID.
+func GetSilences(bosunhost string) (map[string]*Silence, error) {
+	return (&Bosun{Host: bosunhost}).Get()
+}
+
+// findID returns the ID Bosun gave the silence s, or "" if it can't be found.
+func (b *Bosun) findID(s *SilenceRequest) string {
+	silences, err := b.Get()
+	if err != nil {
+		return ""
+	}
+	for id, found := range silences {
+		if found.Alert == s.Alert && found.TagString == s.Tags && found.User == s.User &&
+			found.Message == s.Message && found.End.UTC().Format(timeFormat) == s.End {
+			return id
+		}
+	}
+	return ""
+}
+
+// url returns the URL of an API endpoint on this Bosun.
+func (b *Bosun) url(path string) (*url.URL, error) {
+	host := b.Host
+	if host == "" {
+		host = DefaultHost
+	}
+	return bosunURL(host, path)
+}
+
+// bosunURL returns the URL of an API endpoint on bosunhost, which may be
+// either a bare host name or a base URL.
+func bosunURL(bosunhost, path string) (*url.URL, error) {
+	if !strings.Contains(bosunhost, "://") {
+		return &url.URL{Scheme: "https", Host: bosunhost, Path: path}, nil
+	}
+	u, err := url.Parse(bosunhost)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+	return u, nil
+}
@@ -0,0 +1,119 @@
+package silence
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+)
+
+// DefaultTimeout is how long a request to the silencer may take when
+// Config.Timeout isn't set.
+const DefaultTimeout = 30 * time.Second
+
+// Config says which silencer to use and how to talk to it.
+type Config struct {
+	// Backend is "bosun" (the default), "alertmanager" or "webhook".
+	Backend string `yaml:"backend"`
+	// URL of the silencer. For Bosun this may be a bare host name.
+	URL string `yaml:"url"`
+	// CAFile is a PEM bundle of extra CAs to trust, e.g. an internal CA.
+	CAFile string `yaml:"ca_file"`
+	// CertFile and KeyFile are a client certificate to present.
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Token is sent as a bearer token. Otherwise Username and Password,
+	// if set, are sent with basic auth.
+	Token    string `yaml:"token"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// Timeout limits each request. Zero means DefaultTimeout.
+	Timeout time.Duration `yaml:"timeout"`
+	// MaxDuration is the longest silence users may set; see MaxDuration.
+	MaxDuration time.Duration `yaml:"max_duration"`
+}
+
+// New returns the Silencer described by c.
+func New(c Config) (Silencer, error) {
+	client, err := c.client()
+	if err != nil {
+		return nil, err
+	}
+	switch c.Backend {
+	case "", "bosun":
+		return &Bosun{Host: c.URL, Client: client}, nil
+	case "alertmanager":
+		if c.URL == "" {
+			return nil, fmt.Errorf("the alertmanager silencer needs a URL")
+		}
+		return &Alertmanager{URL: c.URL, Client: client}, nil
+	case "webhook":
+		if c.URL == "" {
+			return nil, fmt.Errorf("the webhook silencer needs a URL")
+		}
+		return &Webhook{URL: c.URL, Client: client}, nil
+	}
+	return nil, fmt.Errorf("unknown silencer %q", c.Backend)
+}
+
+// client builds an http.Client with c's TLS, auth and timeout settings.
+func (c Config) client() (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if c.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			// Windows has no system pool before Go 1.18
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+
+	timeout := c.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	return &http.Client{
+		Transport: &authTransport{base: transport, token: c.Token, username: c.Username, password: c.Password},
+		Timeout:   timeout,
+	}, nil
+}
+
+// authTransport adds an Authorization header to every request.
+type authTransport struct {
+	base               http.RoundTripper
+	token              string
+	username, password string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.token == "" && t.username == "" {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrippers mustn't modify the request they're given.
+	req = req.Clone(req.Context())
+	if t.token != "" {
+		req.Header.Set("Authorization", "Bearer "+t.token)
+	} else {
+		req.SetBasicAuth(t.username, t.password)
+	}
+	return t.base.RoundTrip(req)
+}
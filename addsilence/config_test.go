@@ -0,0 +1,101 @@
+package silence
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		backend string
+		url     string
+		ok      bool
+	}{
+		{"", "", true},
+		{"bosun", "http://bosun:8070", true},
+		{"alertmanager", "http://alertmanager:9093", true},
+		{"alertmanager", "", false},
+		{"webhook", "https://hooks.example.com/silence", true},
+		{"webhook", "", false},
+		{"nagios", "", false},
+	}
+	for i, test := range tests {
+		_, err := New(Config{Backend: test.backend, URL: test.url})
+		if (err == nil) != test.ok {
+			t.Errorf("%v: New(%q, %q) returned %v", i, test.backend, test.url, err)
+		}
+	}
+}
+
+func TestConfigTLSAndAuth(t *testing.T) {
+	var auth string
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer ts.Close()
+
+	// Trust the test server's self-signed certificate as if it were our internal CA.
+	dir, err := ioutil.TempDir("", "silence")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		config Config
+		e1     string
+	}{
+		{Config{Token: "s3cret"}, "Bearer s3cret"},
+		{Config{Username: "pat", Password: "pw"}, "Basic cGF0OnB3"},
+		{Config{}, ""},
+	}
+	for i, test := range tests {
+		test.config.URL = ts.URL
+		test.config.CAFile = caFile
+		s, err := New(test.config)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if err := s.Clear("x"); err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		if auth != test.e1 {
+			t.Errorf("%v: expected Authorization (%v) got (%v)", i, test.e1, auth)
+		}
+	}
+
+	// Without the CA the server isn't trusted.
+	s, err := New(Config{URL: ts.URL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clear("x"); err == nil {
+		t.Error("expected a certificate error")
+	}
+}
+
+func TestConfigTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer ts.Close()
+
+	s, err := New(Config{URL: ts.URL, Timeout: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Clear("x"); err == nil {
+		t.Error("expected a timeout")
+	}
+}
@@ -0,0 +1,119 @@
+package silence
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxDuration is the longest a silence may last, counting from now. Zero
+// means there's no limit.
+var MaxDuration = 7 * 24 * time.Hour
+
+// ParseEnd works out when a silence that starts at start and lasts for
+// duration ends. As well as anything time.ParseDuration understands,
+// duration may be a number of days ("1d", "1d12h"), or "until" a local time
+// ("until 17:00", which means tomorrow if 17:00 has passed, or
+// "until 2006-01-02 15:04"). The silence must end after start, and no more
+// than MaxDuration from now.
+func ParseEnd(duration string, start time.Time) (time.Time, error) {
+	now := time.Now()
+	end, err := parseEnd(duration, start, now)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !end.After(start) {
+		return time.Time{}, fmt.Errorf("silence for %q would end before it starts", duration)
+	}
+	if MaxDuration > 0 && end.Sub(now) > MaxDuration {
+		return time.Time{}, fmt.Errorf("silence for %q is longer than the maximum of %v", duration, MaxDuration)
+	}
+	return end, nil
+}
+
+// ParseDeadline is ParseEnd for things other than silences, which
+// MaxDuration doesn't limit.
+func ParseDeadline(duration string, start time.Time) (time.Time, error) {
+	end, err := parseEnd(duration, start, time.Now())
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !end.After(start) {
+		return time.Time{}, fmt.Errorf("%q has already passed", duration)
+	}
+	return end, nil
+}
+
+func parseEnd(duration string, start, now time.Time) (time.Time, error) {
+	if until := strings.TrimPrefix(duration, "until "); until != duration {
+		return parseUntil(strings.TrimSpace(until), now)
+	}
+	d, err := parseDuration(duration)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return start.Add(d), nil
+}
+
+// ParseAgo parses a time to look back to: a duration before now, as
+// ParseEnd takes them ("7d", "36h"), or a local date and time
+// ("2006-01-02", "2006-01-02 15:04").
+func ParseAgo(s string, now time.Time) (time.Time, error) {
+	if d, err := parseDuration(s); err == nil && d >= 0 {
+		return now.Add(-d), nil
+	}
+	for _, format := range untilFormats[1:] {
+		if t, err := time.ParseInLocation(format, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't understand the time %q; try 7d, 36h or 2006-01-02 15:04", s)
+}
+
+var daysRegexp = regexp.MustCompile(`^(\d+)d(.*)$`)
+
+// parseDuration is time.ParseDuration plus days.
+func parseDuration(s string) (time.Duration, error) {
+	m := daysRegexp.FindStringSubmatch(s)
+	if m == nil {
+		return time.ParseDuration(s)
+	}
+	days, err := strconv.Atoi(m[1])
+	if err != nil {
+		return 0, err
+	}
+	d := time.Duration(days) * 24 * time.Hour
+	if m[2] == "" {
+		return d, nil
+	}
+	rest, err := time.ParseDuration(m[2])
+	if err != nil {
+		return 0, fmt.Errorf("time: invalid duration %q", s)
+	}
+	return d + rest, nil
+}
+
+var untilFormats = []string{"15:04", "2006-01-02 15:04", "2006-01-02T15:04", "2006-01-02"}
+
+// parseUntil parses a local time of day, or date and time.
+func parseUntil(s string, now time.Time) (time.Time, error) {
+	for i, format := range untilFormats {
+		t, err := time.ParseInLocation(format, s, time.Local)
+		if err != nil {
+			continue
+		}
+		if i > 0 {
+			return t, nil
+		}
+		// Just a time of day: the next time it comes around.
+		now = now.Local()
+		t = time.Date(now.Year(), now.Month(), now.Day(), t.Hour(), t.Minute(), 0, 0, time.Local)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("can't understand the time %q; try 17:00 or 2006-01-02 17:00", s)
+}
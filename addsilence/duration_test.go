@@ -0,0 +1,119 @@
+package silence
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseEnd(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		duration string
+		e1       time.Duration
+	}{
+		{"1h", time.Hour},
+		{"90m", 90 * time.Minute},
+		{"1d", 24 * time.Hour},
+		{"1d12h", 36 * time.Hour},
+		{"2d30m", 48*time.Hour + 30*time.Minute},
+	}
+	for i, test := range tests {
+		end, err := ParseEnd(test.duration, now)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if got := end.Sub(now); got != test.e1 {
+			t.Errorf("%v: %q: expected (%v) got (%v)", i, test.duration, test.e1, got)
+		}
+	}
+
+	for i, bad := range []string{"3hr", "", "-1h", "0s", "1x", "1d3", "until teatime", "until 2000-01-01 10:00", "30d"} {
+		if _, err := ParseEnd(bad, now); err == nil {
+			t.Errorf("%v: expected %q to be rejected", i, bad)
+		}
+	}
+}
+
+func TestParseEndUntil(t *testing.T) {
+	now := time.Now()
+	soon := now.Add(90 * time.Minute).Truncate(time.Minute)
+	end, err := ParseEnd("until "+soon.Format("15:04"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !end.Equal(soon) {
+		t.Errorf("expected (%v) got (%v)", soon, end)
+	}
+
+	// A time that has already passed today means tomorrow.
+	earlier := now.Add(-time.Hour).Truncate(time.Minute)
+	end, err = ParseEnd("until "+earlier.Format("15:04"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !end.Equal(earlier.AddDate(0, 0, 1)) {
+		t.Errorf("expected (%v) got (%v)", earlier.AddDate(0, 0, 1), end)
+	}
+
+	tomorrow := now.AddDate(0, 0, 1).Truncate(time.Minute)
+	end, err = ParseEnd("until "+tomorrow.Format("2006-01-02 15:04"), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !end.Equal(tomorrow) {
+		t.Errorf("expected (%v) got (%v)", tomorrow, end)
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	defer func(d time.Duration) { MaxDuration = d }(MaxDuration)
+	MaxDuration = 2 * time.Hour
+	now := time.Now()
+	if _, err := ParseEnd("2h", now); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseEnd("3h", now); err == nil {
+		t.Error("expected 3h to exceed the maximum")
+	}
+	MaxDuration = 0
+	if _, err := ParseEnd("30d", now); err != nil {
+		t.Error(err)
+	}
+	// Only silences are limited
+	MaxDuration = 2 * time.Hour
+	if _, err := ParseDeadline("30d", now); err != nil {
+		t.Error(err)
+	}
+	if _, err := ParseDeadline("-1h", now); err == nil {
+		t.Error("expected a deadline before now to be an error")
+	}
+}
+
+func TestParseAgo(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		ago      string
+		expected time.Time
+	}{
+		{"36h", now.Add(-36 * time.Hour)},
+		{"7d", now.Add(-7 * 24 * time.Hour)},
+		{"2020-03-04", time.Date(2020, 3, 4, 0, 0, 0, 0, time.Local)},
+		{"2020-03-04 15:04", time.Date(2020, 3, 4, 15, 4, 0, 0, time.Local)},
+	}
+	for i, test := range tests {
+		got, err := ParseAgo(test.ago, now)
+		if err != nil {
+			t.Errorf("%v: %v", i, err)
+			continue
+		}
+		if !got.Equal(test.expected) {
+			t.Errorf("%v: %q: expected (%v) got (%v)", i, test.ago, test.expected, got)
+		}
+	}
+	for i, bad := range []string{"", "-1h", "last week", "15:04"} {
+		if _, err := ParseAgo(bad, now); err == nil {
+			t.Errorf("%v: expected %q to be rejected", i, bad)
+		}
+	}
+}
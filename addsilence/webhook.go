@@ -0,0 +1,78 @@
+package silence
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+)
+
+// Webhook POSTs silences as JSON to a URL, for monitoring systems we don't
+// support directly. Setting a silence sends the SilenceRequest fields plus
+// "action": "set"; the response may be a JSON object with an "id". Clearing
+// sends {"action": "clear", "id": ...}.
+type Webhook struct {
+	URL string
+	// Client is used for all requests. Nil means http.DefaultClient.
+	Client *http.Client
+}
+
+// Request returns a POST of s to the webhook.
+func (w *Webhook) Request(s *SilenceRequest) (*http.Request, error) {
+	return w.request(struct {
+		Action string `json:"action"`
+		*SilenceRequest
+	}{"set", s})
+}
+
+// Set POSTs s to the webhook.
+func (w *Webhook) Set(s *SilenceRequest) error {
+	req, err := w.Request(s)
+	if err != nil {
+		return err
+	}
+	c, err := do(w.Client, req)
+	if err != nil {
+		return err
+	}
+	var resp struct {
+		ID string `json:"id"`
+	}
+	// The ID is optional, so a response we can't read isn't an error.
+	if json.Unmarshal(c, &resp) == nil {
+		s.ID = resp.ID
+	}
+	return nil
+}
+
+// Clear asks the webhook to remove the silence with the given ID.
+func (w *Webhook) Clear(id string) error {
+	req, err := w.request(map[string]string{"action": "clear", "id": id})
+	if err != nil {
+		return err
+	}
+	_, err = do(w.Client, req)
+	return err
+}
+
+// Find isn't something a webhook can do.
+func (w *Webhook) Find(alert, tags string) ([]string, error) {
+	return nil, ErrNotSupported
+}
+
+// List isn't something a webhook can do either.
+func (w *Webhook) List(tags string) ([]*Silence, error) {
+	return nil, ErrNotSupported
+}
+
+func (w *Webhook) request(v interface{}) (*http.Request, error) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", w.URL, bytes.NewBuffer(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
@@ -0,0 +1,40 @@
+package silence
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	var got []map[string]string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		json.NewDecoder(r.Body).Decode(&body)
+		got = append(got, body)
+		if body["action"] == "set" {
+			w.Write([]byte(`{"id":"42"}`))
+		}
+	}))
+	defer ts.Close()
+
+	w := &Webhook{URL: ts.URL}
+	s := &SilenceRequest{Alert: "puppet.left.disabled", Tags: "host=web01", User: "tester"}
+	if err := w.Set(s); err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != "42" {
+		t.Errorf("expected ID (42) got (%v)", s.ID)
+	}
+	if err := w.Clear(s.ID); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0]["action"] != "set" || got[0]["alert"] != "puppet.left.disabled" ||
+		got[1]["action"] != "clear" || got[1]["id"] != "42" {
+		t.Errorf("unexpected requests %v", got)
+	}
+	if _, err := w.Find("puppet.left.disabled", "host=web01"); err != ErrNotSupported {
+		t.Errorf("expected ErrNotSupported, got %v", err)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/urfave/cli"
+)
+
+// patCommands are the commands that run puppet or change whether it may
+// run, and the flags that may also be given after their names.
+var patCommands = []struct {
+	name, usage, argsUsage string
+	flags                  []string
+}{
+	{"run", "Run 'puppet agent -t' and sum up what changed or failed (what pat does with no command)", "[-- puppet flags]",
+		[]string{"noop", "debug", "timestamp", "verbose", "server", "environment", "wait", "timeout", "retries", "retry-delay", "stderr-style"}},
+	{"disable", "Disable puppet runs, and silence puppet.left.disabled", "[message...]",
+		[]string{"for", "until", "s", "ticket", "nosilence", "silence-dry-run", "noop", "debug", "timestamp"}},
+	{"enable", "Enable puppet runs, and clear the silences set when it was disabled", "",
+		[]string{"force", "reason", "nosilence", "silence-dry-run", "noop", "debug", "timestamp"}},
+	{"once", "Run puppet. If puppet was disabled, re-disable it when done", "[-- puppet flags]",
+		[]string{"noop", "debug", "timestamp", "verbose", "server", "environment", "wait", "timeout", "retries", "retry-delay", "stderr-style", "s", "nosilence", "silence-dry-run"}},
+	{"status", "Report whether puppet is disabled, and how its last run went", "",
+		[]string{"format", "timestamp"}},
+	{"facts", "Run 'puppet facts' instead of 'puppet agent'", "[-- puppet flags]",
+		[]string{"debug", "timestamp", "verbose", "environment", "stderr-style"}},
+	{"reap", "Enable puppet and run it if a disable with --for or --until has run out (for cron or a timer)", "",
+		[]string{"debug", "timestamp", "wait", "timeout", "retries", "retry-delay", "stderr-style"}},
+}
+
+// newCommands makes the commands in patCommands, picking their flags from
+// the app's.
+func newCommands(flags []cli.Flag) []cli.Command {
+	var commands []cli.Command
+	for _, c := range patCommands {
+		commands = append(commands, cli.Command{
+			Name:      c.name,
+			Usage:     c.usage,
+			ArgsUsage: c.argsUsage,
+			Flags:     commandFlags(flags, c.flags...),
+			Action:    doPatCommand,
+			//See disableArgs
+			SkipFlagParsing: c.name == "disable",
+		})
+	}
+	return commands
+}
+
+// commandFlags picks the named flags from flags. Their environment variables
+// are left to the flags they were picked from, so that a variable can't
+// override a flag given before the command's name.
+func commandFlags(flags []cli.Flag, names ...string) []cli.Flag {
+	var picked []cli.Flag
+	for _, name := range names {
+		for _, f := range flags {
+			if flagName(f) != name {
+				continue
+			}
+			switch f := f.(type) {
+			case cli.BoolFlag:
+				f.EnvVar = ""
+				picked = append(picked, f)
+			case cli.StringFlag:
+				f.EnvVar = ""
+				picked = append(picked, f)
+			case cli.IntFlag:
+				f.EnvVar = ""
+				picked = append(picked, f)
+			case cli.DurationFlag:
+				f.EnvVar = ""
+				picked = append(picked, f)
+			}
+		}
+	}
+	return picked
+}
+
+// flagName is the first of a flag's names, which is the one pat looks it up by.
+func flagName(f cli.Flag) string {
+	return strings.TrimSpace(strings.Split(f.GetName(), ",")[0])
+}
+
+// CMD: run, disable, enable, once, status, facts or reap
+func doPatCommand(c *cli.Context) error {
+	args := []string(c.Args())
+	if c.Command.SkipFlagParsing {
+		var err error
+		args, err = disableArgs(c)
+		if err != nil || args == nil {
+			return err
+		}
+	}
+	//The flags given after the command's name are passed on to the app's,
+	//which is where pat reads them from
+	for _, f := range c.Command.Flags {
+		name := flagName(f)
+		if name == "help" || !c.IsSet(name) {
+			continue
+		}
+		if err := c.GlobalSet(name, c.String(name)); err != nil {
+			return err
+		}
+	}
+	if config, err := getConfig(c); err == nil {
+		overrideConfig(c, config)
+	}
+	return startPat(c.Parent(), c.Command.Name, args)
+}
+
+// disableArgs sorts the words after "pat disable" into flags, which are set
+// as the app's are, and the message, which it returns. cli would move the
+// flags ahead of the message, and take the word after a bool flag for its
+// value, so that "upgrading --nosilence nginx" became "nginx upgrading".
+// Everything after "--" is message. It returns nil if help was shown.
+func disableArgs(c *cli.Context) ([]string, error) {
+	flags := map[string]cli.Flag{}
+	for _, f := range c.Command.Flags {
+		for _, name := range strings.Split(f.GetName(), ",") {
+			flags[strings.TrimSpace(name)] = f
+		}
+	}
+	args := c.Args()
+	message := []string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			return append(message, args[i+1:]...), nil
+		}
+		if a == "-" || !strings.HasPrefix(a, "-") {
+			message = append(message, a)
+			continue
+		}
+		name, value := strings.TrimLeft(a, "-"), ""
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name, value = name[:strings.Index(name, "=")], name[strings.Index(name, "=")+1:]
+		}
+		f, ok := flags[name]
+		switch {
+		case !ok:
+			return nil, fmt.Errorf("flag provided but not defined: %s", a)
+		case flagName(f) == "help":
+			return nil, cli.ShowCommandHelp(c, c.Command.Name)
+		}
+		if _, isBool := f.(cli.BoolFlag); isBool && !hasValue {
+			value = "true"
+		} else if !hasValue {
+			if i+1 == len(args) {
+				return nil, fmt.Errorf("flag needs an argument: %s", a)
+			}
+			i++
+			value = args[i]
+		}
+		if err := c.GlobalSet(flagName(f), value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for flag %s: %v", value, a, err)
+		}
+	}
+	return message, nil
+}
+
+// legacyFlags are the flags that said what pat should do before it had
+// commands for them.
+var legacyFlags = map[string]bool{"disable": true, "once": true, "enable": true, "status": true, "facts": true}
+
+// legacyArgs turns the flags that used to say what pat should do (--disable
+// message, --once and so on) into the command that now does it, along with
+// a warning that says what to use instead. args are returned unchanged if
+// none of the old flags are given before "--", or if a command is given.
+// boolFlags are the flags that don't take a value.
+func legacyArgs(args []string, boolFlags map[string]bool) ([]string, string) {
+	var flags, message, puppetArgs []string
+	command, old := "", ""
+	for i := 1; i < len(args); i++ {
+		a := args[i]
+		if a == "--" {
+			if command == "disable" {
+				message = append(message, args[i+1:]...)
+			} else {
+				puppetArgs = append(puppetArgs, args[i+1:]...)
+			}
+			break
+		}
+		if a == "-" || !strings.HasPrefix(a, "-") {
+			switch {
+			case command == "":
+				//A command, or puppet flags given the old way
+				return args, ""
+			case command == "disable":
+				//The words after --disable, wherever they are, are its message
+				if a != "" {
+					message = append(message, a)
+				}
+			default:
+				puppetArgs = append(puppetArgs, a)
+			}
+			continue
+		}
+		name := strings.TrimLeft(a, "-")
+		value := ""
+		hasValue := strings.Contains(name, "=")
+		if hasValue {
+			name, value = name[:strings.Index(name, "=")], name[strings.Index(name, "=")+1:]
+		}
+		switch {
+		case legacyFlags[name] && (command == "" || command == name) && (!hasValue || value == "true"):
+			command, old = name, "--"+name
+		case name == "disable-message":
+			if !hasValue && i+1 < len(args) {
+				value = args[i+1]
+				i++
+			}
+			message = append(message, strings.Trim(value, "\""))
+		default:
+			flags = append(flags, a)
+			if !hasValue && !boolFlags[name] && i+1 < len(args) {
+				flags = append(flags, args[i+1])
+				i++
+			}
+		}
+	}
+	if command == "" {
+		return args, ""
+	}
+
+	newArgs := append([]string{args[0]}, flags...)
+	newArgs = append(newArgs, command)
+	warning := fmt.Sprintf("WARNING: %s is deprecated; use 'pat %s' instead", old, command)
+	if command == "disable" {
+		warning = fmt.Sprintf("WARNING: %s is deprecated; use 'pat disable [message...]' instead", old)
+		if len(message) > 0 {
+			newArgs = append(newArgs, "--", strings.Join(message, " "))
+		}
+		return newArgs, warning
+	}
+	if len(puppetArgs) > 0 {
+		newArgs = append(append(newArgs, "--"), puppetArgs...)
+	}
+	return newArgs, warning
+}
+
+// boolFlagNames are the names (and other names) of the flags in flags that
+// don't take a value.
+func boolFlagNames(flags []cli.Flag) map[string]bool {
+	names := map[string]bool{}
+	for _, f := range flags {
+		if _, ok := f.(cli.BoolFlag); ok {
+			for _, name := range strings.Split(f.GetName(), ",") {
+				names[strings.TrimSpace(name)] = true
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"text/template"
+	"time"
+
+	silence "github.com/StackExchange/pat/addsilence"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The config files, read in this order: the user's takes precedence over the
+// system's, and environment variables and flags over both. Tests change them.
+var (
+	systemConfigFile = osConfigFile
+	userConfigFile   = osUserConfigFile()
+)
+
+// patConfig is the contents of pat's config files.
+type patConfig struct {
+	Puppet   puppetSettings  `yaml:"puppet"`
+	Silence  silenceSettings `yaml:"silence"`
+	Messages messageSettings `yaml:"messages"`
+	Policy   policySettings  `yaml:"policy"`
+	// Flags are defaults for any of pat's other flags, by name.
+	Flags map[string]string `yaml:"flags,omitempty"`
+}
+
+// puppetSettings say where puppet is, and how to run it.
+type puppetSettings struct {
+	// Bin is the puppet command.
+	Bin string `yaml:"bin"`
+	// StateDir is where puppet keeps its state, and pat its own alongside.
+	// If it isn't set, puppet is asked.
+	StateDir string `yaml:"state_dir"`
+	// Environment is the environment to run in, if not puppet's own default.
+	Environment string `yaml:"environment"`
+}
+
+// silenceSettings are how to reach the silencer, and what to silence.
+type silenceSettings struct {
+	silence.Config `yaml:",inline"`
+	// Duration is how long to silence for, unless -s says otherwise.
+	Duration string `yaml:"duration"`
+	// FQDN silences this host by its fully qualified name rather than its shortname.
+	FQDN bool `yaml:"fqdn"`
+	// Hosts are the names to silence instead of this host's.
+	Hosts []string `yaml:"hosts"`
+	// Tags are extra key=value tags the silence must match.
+	Tags []string `yaml:"tags"`
+}
+
+// messageSettings are text/templates for the messages pat writes for you.
+type messageSettings struct {
+	// Disable is the message offered when pat disable isn't given one. It
+	// may use {{.Name}}, {{.User}}, {{.Host}} and {{.Duration}}.
+	Disable string `yaml:"disable"`
+	// Silence is the silence's message. It may use {{.Message}} (the
+	// disable message), {{.User}}, {{.Host}} and {{.Ticket}}.
+	Silence string `yaml:"silence"`
+}
+
+// policySettings are the rules pat enforces. Only the system config may set
+// them, as they are for whoever runs the host to decide.
+type policySettings struct {
+	// EnableGrace is how long only the user who disabled puppet may enable
+	// it again without --force. 0 lets anyone.
+	EnableGrace time.Duration `yaml:"enable_grace"`
+}
+
+const (
+	defaultDisableTemplate = "Disabled by {{.Name}}. If I forget to re-enable it after 2 hours, anyone may re-enable and any problems this causes are my responsibility."
+	defaultSilenceTemplate = "{{.Message}}"
+)
+
+// Flags that can't be given defaults in the config file: they say where the
+// config is, don't run anything, or override someone else's disable, which
+// should be done on purpose each time.
+var configOnlyOnCommandLine = map[string]bool{
+	"config": true, "user-config": true, "help": true, "version": true,
+	"force": true, "reason": true,
+}
+
+// Flags that the config file sets in its puppet section instead, as they
+// say where puppet is before the flags section is read.
+var configInPuppetSection = map[string]string{"puppet-bin": "bin", "state-dir": "state_dir"}
+
+// defaultConfig is pat's settings when nothing else is said.
+func defaultConfig() *patConfig {
+	c := &patConfig{
+		Puppet: puppetSettings{
+			Bin: puppetBinPath,
+		},
+		Messages: messageSettings{
+			Disable: defaultDisableTemplate,
+			Silence: defaultSilenceTemplate,
+		},
+		Policy: policySettings{
+			EnableGrace: 2 * time.Hour,
+		},
+	}
+	c.Silence.Backend = "bosun"
+	c.Silence.Duration = "1h"
+	c.Silence.Timeout = silence.DefaultTimeout
+	c.Silence.MaxDuration = silence.MaxDuration
+	return c
+}
+
+// Read a config file over config. It's fine for a default one not to
+// exist, but not one we were pointed at.
+func readConfig(path string, explicit bool, config *patConfig) error {
+	contents, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && !explicit {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	//Anyone who can change the config can choose what puppet command is run
+	if fi, err := os.Stat(path); err == nil && !osTrustConfig(fi) {
+		if explicit {
+			return fmt.Errorf("%s: may be changed by others than root and its owner", path)
+		}
+		tsLn("WARNING: Ignoring", path+": it may be changed by others than root and its owner")
+		return nil
+	}
+	//Check the file on its own, as strict unmarshalling into what earlier
+	//files said would take their flags for duplicates
+	if err := yaml.UnmarshalStrict(contents, &patConfig{}); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return yaml.Unmarshal(contents, config)
+}
+
+// loadConfig reads the config files, and overrides them with any flags (or
+// environment variables) that were set.
+func loadConfig(pat *cli.Context) (*patConfig, error) {
+	config := defaultConfig()
+	path := pat.GlobalString("config")
+	if err := readConfig(path, pat.GlobalIsSet("config"), config); err != nil {
+		return nil, err
+	}
+	//The policy binds whoever runs pat, so it comes from the system config
+	//alone: not from a file they point --config at
+	policy := config.Policy
+	if filepath.Clean(path) != filepath.Clean(systemConfigFile) {
+		system := defaultConfig()
+		if err := readConfig(systemConfigFile, false, system); err != nil {
+			return nil, err
+		}
+		policy = system.Policy
+		keepPolicy(config, policy, path)
+	}
+	if path := pat.GlobalString("user-config"); path != "" {
+		if err := readConfig(path, pat.GlobalIsSet("user-config"), config); err != nil {
+			return nil, err
+		}
+		keepPolicy(config, policy, path)
+	}
+	overrideConfig(pat, config)
+
+	for name, text := range map[string]string{"disable": config.Messages.Disable, "silence": config.Messages.Silence} {
+		if _, err := template.New(name).Parse(text); err != nil {
+			return nil, fmt.Errorf("bad %s message template: %v", name, err)
+		}
+	}
+	for name := range config.Flags {
+		if configOnlyOnCommandLine[name] {
+			return nil, fmt.Errorf("--%s can't be set in the config file", name)
+		}
+		if key, ok := configInPuppetSection[name]; ok {
+			return nil, fmt.Errorf("--%s can't be set in the config file's flags; set %s in its puppet section instead", name, key)
+		}
+	}
+	return config, nil
+}
+
+// keepPolicy puts back policy if the config file at path changed it.
+func keepPolicy(config *patConfig, policy policySettings, path string) {
+	if config.Policy != policy {
+		tsLn("WARNING: Ignoring the policy in", path+": only", systemConfigFile, "may set it")
+		config.Policy = policy
+	}
+}
+
+// overrideConfig overrides what the config files say with any flags (or
+// environment variables) that were set.
+func overrideConfig(pat *cli.Context, config *patConfig) {
+	config.Silence = silenceConfig(pat, config.Silence)
+	if pat.GlobalIsSet("puppet-bin") {
+		config.Puppet.Bin = pat.GlobalString("puppet-bin")
+	}
+	if pat.GlobalIsSet("state-dir") {
+		config.Puppet.StateDir = pat.GlobalString("state-dir")
+	}
+	if pat.GlobalIsSet("environment") {
+		config.Puppet.Environment = pat.GlobalString("environment")
+	}
+	if pat.GlobalIsSet("s") {
+		config.Silence.Duration = pat.GlobalString("s")
+	}
+}
+
+// setupConfig loads the config before any command runs, points pat at
+// puppet, and gives the flags that weren't set their defaults from the
+// config. Any error is kept for getConfig, as cli would follow an error from
+// here with the whole help.
+func setupConfig(pat *cli.Context) error {
+	config, err := loadConfig(pat)
+	if err == nil {
+		err = applyConfig(pat, config)
+	}
+	if err != nil {
+		pat.App.Metadata["configError"] = err
+		return nil
+	}
+	pat.App.Metadata["config"] = config
+	return nil
+}
+
+// Commands that don't need to know where puppet keeps its state, so don't
+// ask it
+var commandsWithoutPuppet = map[string]bool{"logs": true, "help": true, "h": true}
+
+func applyConfig(pat *cli.Context, config *patConfig) error {
+	for name, value := range config.Flags {
+		if pat.GlobalIsSet(name) {
+			continue
+		}
+		if err := pat.GlobalSet(name, value); err != nil {
+			return fmt.Errorf("config: flag %s: %v", name, err)
+		}
+	}
+	//The flags the config gave defaults to count as set now, so go over them
+	//again, or only commands that read the flags themselves would see them
+	overrideConfig(pat, config)
+
+	puppetBinPath = findPuppet(config.Puppet.Bin)
+	if config.Puppet.StateDir != "" {
+		setStateDir(config.Puppet.StateDir)
+	} else if !commandsWithoutPuppet[pat.Args().First()] {
+		if settings, err := getPuppetSettings(); err == nil {
+			setPuppetPaths(settings)
+		} else if pat.GlobalBool("debug") {
+			tsLn("DEBUG: Could not ask puppet where its state is, so assuming", filepath.Dir(puppetLockFile)+":", err)
+		}
+	}
+	return nil
+}
+
+// getConfig returns the config setupConfig loaded.
+func getConfig(pat *cli.Context) (*patConfig, error) {
+	if err, ok := pat.App.Metadata["configError"].(error); ok {
+		return nil, err
+	}
+	if config, ok := pat.App.Metadata["config"].(*patConfig); ok {
+		return config, nil
+	}
+	return loadConfig(pat)
+}
+
+// Set up silence.Default from the config, and return the host names to
+// silence and the tags that match them
+func setupSilencer(pat *cli.Context) ([]string, string, error) {
+	config, err := getConfig(pat)
+	if err != nil {
+		return nil, "", err
+	}
+	s := config.Silence
+	if s.MaxDuration != 0 {
+		silence.MaxDuration = s.MaxDuration
+	}
+	silence.Default, err = silence.New(s.Config)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hosts := s.Hosts
+	if len(hosts) == 0 {
+		hosts = []string{silence.LocalHost(s.FQDN)}
+	}
+	tags, err := silence.MakeTags(hosts, s.Tags)
+	return hosts, tags, err
+}
+
+// CMD: config show
+func doConfigShow(c *cli.Context) error {
+	config, err := getConfig(c)
+	if err != nil {
+		return err
+	}
+	shown := *config
+	//Don't show secrets
+	for _, secret := range []*string{&shown.Silence.Token, &shown.Silence.Password} {
+		if *secret != "" {
+			*secret = "REDACTED"
+		}
+	}
+	out, err := yaml.Marshal(&shown)
+	if err != nil {
+		return err
+	}
+	fmt.Println("# pat's settings, from the defaults, then")
+	for _, path := range []string{c.GlobalString("config"), c.GlobalString("user-config")} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			fmt.Printf("#   %s (not found)\n", path)
+		} else {
+			fmt.Printf("#   %s\n", path)
+		}
+	}
+	fmt.Println("# then environment variables and flags.")
+	fmt.Print(string(out))
+	fmt.Println("# Puppet's state, from state_dir, puppet config print, or the defaults:")
+	fmt.Println("#   agent_disabled_lockfile:", puppetLockFile)
+	fmt.Println("#   lastrunfile:", puppetLastRunFile)
+	fmt.Println("#   lastrunreport:", puppetReportFile)
+	fmt.Println("#   agent_catalog_run_lockfile:", puppetRunLockFile)
+	if puppetServer != "" {
+		fmt.Println("#   server:", puppetServer)
+	}
+	return nil
+}
+
+// osUserConfigFile is the user's config file, under their config directory.
+func osUserConfigFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "pat", "config.yaml")
+}
+
+// Override the config files' silence settings with any flags (or environment variables) that were set
+func silenceConfig(pat *cli.Context, c silenceSettings) silenceSettings {
+	stringFlags := []struct {
+		name  string
+		value *string
+	}{
+		{"silencer", &c.Backend},
+		{"silence-url", &c.URL},
+		{"silence-ca", &c.CAFile},
+		{"silence-cert", &c.CertFile},
+		{"silence-key", &c.KeyFile},
+		{"silence-token", &c.Token},
+		{"silence-user", &c.Username},
+		{"silence-password", &c.Password},
+	}
+	for _, f := range stringFlags {
+		if pat.GlobalIsSet(f.name) {
+			*f.value = pat.GlobalString(f.name)
+		}
+	}
+	if pat.GlobalIsSet("silence-timeout") {
+		c.Timeout = pat.GlobalDuration("silence-timeout")
+	}
+	if pat.GlobalIsSet("silence-max") {
+		c.MaxDuration = pat.GlobalDuration("silence-max")
+	}
+	if pat.GlobalIsSet("silence-fqdn") {
+		c.FQDN = pat.GlobalBool("silence-fqdn")
+	}
+	if pat.GlobalIsSet("silence-host") {
+		c.Hosts = pat.GlobalStringSlice("silence-host")
+	}
+	if pat.GlobalIsSet("silence-tag") {
+		c.Tags = pat.GlobalStringSlice("silence-tag")
+	}
+	return c
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	silence "github.com/StackExchange/pat/addsilence"
+	"github.com/urfave/cli"
+)
+
+func TestSetupSilencer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	configFile := filepath.Join(dir, "config.yaml")
+	err = ioutil.WriteFile(configFile, []byte(`
+silence:
+  backend: alertmanager
+  url: http://alertmanager:9093
+  timeout: 5s
+  max_duration: 3h
+  hosts: [web01, web01.example.com]
+  tags: [cluster=ny]
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(d time.Duration, s silence.Silencer) { silence.MaxDuration, silence.Default = d, s }(silence.MaxDuration, silence.Default)
+
+	tests := []struct {
+		args []string
+		env  string
+		url  string
+		tags string
+	}{
+		{nil, "", "http://alertmanager:9093", "cluster=ny,host=web01|web01.example.com"},
+		{[]string{"--silence-url", "http://am:9093"}, "", "http://am:9093", "cluster=ny,host=web01|web01.example.com"},
+		{nil, "http://env:9093", "http://env:9093", "cluster=ny,host=web01|web01.example.com"},
+		{[]string{"--silence-host", "db01", "--silence-tag", "role=db"}, "", "http://alertmanager:9093", "host=db01,role=db"},
+	}
+	for i, test := range tests {
+		os.Unsetenv("PAT_SILENCE_URL")
+		if test.env != "" {
+			os.Setenv("PAT_SILENCE_URL", test.env)
+		}
+		var tags string
+		app := newApp()
+		app.Action = func(c *cli.Context) (err error) {
+			_, tags, err = setupSilencer(c)
+			return err
+		}
+		if err := app.Run(append([]string{"pat", "--config", configFile}, test.args...)); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		am, ok := silence.Default.(*silence.Alertmanager)
+		if !ok {
+			t.Fatalf("%v: expected an Alertmanager, got %T", i, silence.Default)
+		}
+		if am.URL != test.url {
+			t.Errorf("%v: expected URL (%v) got (%v)", i, test.url, am.URL)
+		}
+		if am.Client.Timeout != 5*time.Second {
+			t.Errorf("%v: expected a 5s timeout, got %v", i, am.Client.Timeout)
+		}
+		if tags != test.tags {
+			t.Errorf("%v: expected tags (%v) got (%v)", i, test.tags, tags)
+		}
+		if silence.MaxDuration != 3*time.Hour {
+			t.Errorf("%v: expected a 3h maximum, got %v", i, silence.MaxDuration)
+		}
+	}
+	os.Unsetenv("PAT_SILENCE_URL")
+}
+
+func TestReadConfig(t *testing.T) {
+	missing := filepath.Join(os.TempDir(), "no-such-pat-config.yaml")
+	if err := readConfig(missing, false, defaultConfig()); err != nil {
+		t.Errorf("a missing default config file should be fine, got %v", err)
+	}
+	if err := readConfig(missing, true, defaultConfig()); err == nil {
+		t.Error("a missing explicit config file should be an error")
+	}
+}
+
+func TestLayeredConfig(t *testing.T) {
+	dir, done := useStateDir(t)
+	defer done()
+	defer func(bin string) { puppetBinPath = bin }(puppetBinPath)
+	defer func(d time.Duration, s silence.Silencer) { silence.MaxDuration, silence.Default = d, s }(silence.MaxDuration, silence.Default)
+	err := ioutil.WriteFile(systemConfigFile, []byte(`
+puppet:
+  bin: /usr/local/bin/puppet
+  environment: production
+silence:
+  url: http://bosun-sys
+  duration: 2h
+  token: s3cret
+messages:
+  silence: "{{.Message}} ({{.Ticket}})"
+policy:
+  enable_grace: 30m
+flags:
+  retries: 2
+  timeout: 30m
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(userConfigFile, []byte(`
+silence:
+  duration: 3h
+policy:
+  enable_grace: 0s
+flags:
+  timeout: 45m
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		args        []string
+		env         string
+		environment string
+		duration    string
+		url         string
+		timeout     time.Duration
+	}{
+		{nil, "", "production", "3h", "http://bosun-sys", 45 * time.Minute},
+		{[]string{"--user-config", ""}, "", "production", "2h", "http://bosun-sys", 30 * time.Minute},
+		{nil, "http://env", "production", "3h", "http://env", 45 * time.Minute},
+		{[]string{"-s", "4h", "--env", "dev", "--timeout", "1m", "--silence-url", "http://flag"}, "http://env", "dev", "4h", "http://flag", time.Minute},
+	}
+	for i, test := range tests {
+		os.Unsetenv("PAT_SILENCE_URL")
+		if test.env != "" {
+			os.Setenv("PAT_SILENCE_URL", test.env)
+		}
+		var o *options
+		app := newApp()
+		app.Action = func(c *cli.Context) (err error) {
+			o, err = newOptions(c, "run", c.Args())
+			return err
+		}
+		if err := app.Run(append([]string{"pat"}, test.args...)); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if o.Environment != test.environment {
+			t.Errorf("%v: expected environment (%v) got (%v)", i, test.environment, o.Environment)
+		}
+		if o.SilenceDuration != test.duration {
+			t.Errorf("%v: expected silence duration (%v) got (%v)", i, test.duration, o.SilenceDuration)
+		}
+		if b, ok := silence.Default.(*silence.Bosun); !ok || b.Host != test.url {
+			t.Errorf("%v: expected bosun at (%v) got (%+v)", i, test.url, silence.Default)
+		}
+		if o.Timeout != test.timeout || o.Retries != 2 {
+			t.Errorf("%v: expected timeout (%v) and 2 retries, got (%v) and (%v)", i, test.timeout, o.Timeout, o.Retries)
+		}
+		if o.EnableGrace != 30*time.Minute {
+			t.Errorf("%v: expected the enable grace from the system config only, got (%v)", i, o.EnableGrace)
+		}
+		if o.SilenceTemplate != "{{.Message}} ({{.Ticket}})" {
+			t.Errorf("%v: expected the silence template from the config, got (%v)", i, o.SilenceTemplate)
+		}
+		if puppetBinPath != "/usr/local/bin/puppet" {
+			t.Errorf("%v: expected the puppet command from the config, got (%v)", i, puppetBinPath)
+		}
+	}
+	os.Unsetenv("PAT_SILENCE_URL")
+
+	out := runPat(t, "--state-dir", filepath.Join(dir, "state"), "config", "show")
+	for _, want := range []string{systemConfigFile, userConfigFile, "bin: /usr/local/bin/puppet", "state_dir: " + filepath.Join(dir, "state"), "duration: 3h", "token: REDACTED", "timeout: 45m", "enable_grace: 30m"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected (%v) in:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "s3cret") {
+		t.Errorf("the token was shown:\n%s", out)
+	}
+	if puppetLockFile != filepath.Join(dir, "state", "agent_disabled.lock") {
+		t.Errorf("expected --state-dir to move the state files, got %v", puppetLockFile)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	defer func(bin string) { puppetBinPath = bin }(puppetBinPath)
+
+	//A config file anyone can change is ignored, unless it was asked for
+	if err := ioutil.WriteFile(userConfigFile, []byte("puppet:\n  bin: /tmp/evil\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+	os.Chmod(userConfigFile, 0666)
+	if out := runPat(t, "config", "show"); strings.Contains(out, "/tmp/evil") || !strings.Contains(out, "WARNING: Ignoring") {
+		t.Errorf("expected the user's config to be ignored:\n%s", out)
+	}
+	if _, err := capturePat("--user-config", userConfigFile, "config", "show"); err == nil {
+		t.Errorf("expected an untrustworthy --user-config to be an error")
+	}
+	os.Remove(userConfigFile)
+
+	for i, config := range []string{
+		"puppet:\n  binary: /opt/puppet\n",
+		"messages:\n  disable: \"{{.Name\"\n",
+		"flags:\n  once: \"true\"\n",
+		"flags:\n  no-such-flag: \"1\"\n",
+		"flags:\n  force: \"true\"\n  reason: always\n",
+		"flags:\n  state-dir: /tmp/state\n",
+	} {
+		if err := ioutil.WriteFile(systemConfigFile, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := capturePat("config", "show"); err == nil {
+			t.Errorf("%v: expected %q to be rejected", i, config)
+		}
+	}
+}
+
+func TestConfigFlagsReachPuppet(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	runner := &fakeRunner{}
+	defer func(r func(*options) Runner) { newRunner = r }(newRunner)
+	newRunner = func(o *options) Runner { return runner }
+
+	if err := ioutil.WriteFile(systemConfigFile, []byte("flags:\n  environment: staging\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//Bare pat runs puppet just as pat run does
+	for i, args := range [][]string{nil, {"run"}} {
+		runner.runs = nil
+		if _, err := capturePat(args...); err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		expected := "agent -t --environment staging --detailed-exitcodes"
+		if strings.Join(runner.runs, "; ") != expected {
+			t.Errorf("%v: expected (%v) got (%v)", i, expected, strings.Join(runner.runs, "; "))
+		}
+	}
+}
+
+func TestPolicyOnlyFromSystemConfig(t *testing.T) {
+	dir, done := useStateDir(t)
+	defer done()
+
+	if err := ioutil.WriteFile(systemConfigFile, []byte("policy:\n  enable_grace: 30m\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	//Files that whoever runs pat owns can't lift the guard on enable
+	mine := filepath.Join(dir, "mine.yaml")
+	if err := ioutil.WriteFile(mine, []byte("policy:\n  enable_grace: 0s\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for i, args := range [][]string{
+		{"--config", mine, "config", "show"},
+		{"--user-config", mine, "config", "show"},
+	} {
+		out, err := capturePat(args...)
+		if err != nil || !strings.Contains(out, "enable_grace: 30m") || !strings.Contains(out, "WARNING: Ignoring the policy in "+mine) {
+			t.Errorf("%v: expected the policy in %s to be ignored: %v\n%s", i, mine, err, out)
+		}
+	}
+}
+
+func TestExpandMessage(t *testing.T) {
+	p := newPatCmd(&options{SilenceDuration: "3h", Ticket: "OPS-1"}, &fakeRunner{})
+	tests := []struct {
+		template string
+		expected string
+	}{
+		{"", "upgrading"},
+		{"{{.Message}} ({{.Ticket}}, {{.Duration}})", "upgrading (OPS-1, 3h)"},
+	}
+	for i, test := range tests {
+		got, err := p.expandMessage("silence", test.template, defaultSilenceTemplate, "upgrading")
+		if err != nil || got != test.expected {
+			t.Errorf("%v: expected (%v) got (%v) %v", i, test.expected, got, err)
+		}
+	}
+	if got := p.defaultDisableMessage(); !strings.HasPrefix(got, "Disabled by ") {
+		t.Errorf("expected the default disable message, got (%v)", got)
+	}
+}
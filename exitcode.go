@@ -0,0 +1,42 @@
+package main
+
+import "fmt"
+
+// Exit codes, so that scripts can tell what happened without parsing the output.
+// A puppet run exits as puppet's --detailed-exitcodes do.
+const (
+	exitOK                 = 0
+	exitError              = 1
+	exitChanges            = 2   // the run made changes
+	exitFailures           = 4   // some resources failed
+	exitChangesAndFailures = 6   // both
+	exitDisabled           = 10  // status: puppet is disabled
+	exitUnknown            = 11  // status: whether puppet is disabled couldn't be told
+	exitRunInProgress      = 12  // puppet was already running, and didn't finish within --wait
+	exitTimeout            = 124 // puppet was stopped after --timeout, as timeout(1) exits
+)
+
+// exitStatus is an error that makes pat exit with code. If err is nil, pat
+// exits without printing anything more.
+type exitStatus struct {
+	code int
+	err  error
+}
+
+func (e *exitStatus) Error() string {
+	if e.err == nil {
+		return fmt.Sprintf("exit status %d", e.code)
+	}
+	return e.err.Error()
+}
+
+// exitResult returns the code pat exits with after err, and what is printed.
+func exitResult(err error) (int, error) {
+	if err == nil {
+		return exitOK, nil
+	}
+	if e, ok := err.(*exitStatus); ok {
+		return e.code, e.err
+	}
+	return exitError, err
+}
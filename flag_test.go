@@ -1,27 +1,144 @@
 package main
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
 	"strings"
 	"testing"
 )
 
-func TestPreprocessArgs(t *testing.T) {
+func TestLegacyArgs(t *testing.T) {
 	tests := []struct {
 		data1 string
 		e1    string
+		// deprecated is whether a warning is expected
+		deprecated bool
 	}{
 		// Special case --disable at end of line.
-		{"-disable", "-disable"},
+		{"pat -disable", "pat disable", true},
 		// Simple message.
-		{"-disable message", `-disable --disable-message "message"`},
+		{"pat -disable message", "pat disable -- message", true},
 		// Message is not the end of the command.
-		{"-disable message -flag", `-disable --disable-message "message" -flag`},
+		{"pat -disable message -s 3h", "pat -s 3h disable -- message", true},
+		{"pat --disable rack move --ticket OPS-1", "pat --ticket OPS-1 disable -- rack move", true},
+		{"pat --disable -s 3h rack move", "pat -s 3h disable -- rack move", true},
+		{"pat --disable rack -s 3h move -- now", "pat -s 3h disable -- rack move now", true},
+		{"pat --disable --disable-message message", "pat disable -- message", true},
+		{`pat --disable-message="message" --disable`, "pat disable -- message", true},
+		// Flag values aren't messages or commands.
+		{"pat -e production --once", "pat -e production once", true},
+		{"pat --once --noop -- --tags nginx", "pat --noop once -- --tags nginx", true},
+		{"pat --wait=10m --status --format json", "pat --wait=10m --format json status", true},
+		{"pat --enable", "pat enable", true},
+		{"pat --facts", "pat facts", true},
+		{"pat --once=true", "pat once", true},
+		// Only one of the old flags may be given.
+		{"pat --once --enable", "pat --enable once", true},
+		// Without the old flags, or with a command, nothing changes.
+		{"pat", "pat", false},
+		{"pat -e production", "pat -e production", false},
+		{"pat --noop -- --once", "pat --noop -- --once", false},
+		{"pat silence list", "pat silence list", false},
+		{"pat disable --ticket OPS-1 message", "pat disable --ticket OPS-1 message", false},
+		{"pat --debug once --enable", "pat --debug once --enable", false},
 	}
+	boolFlags := boolFlagNames(newApp().Flags)
 	for i, test := range tests {
-		got := preprocessArgs(strings.Split(test.data1, " "))
+		got, warning := legacyArgs(strings.Split(test.data1, " "), boolFlags)
 		result := strings.Join(got, " ")
 		if result != test.e1 {
 			t.Errorf("%v: expected (%v) got (%v)", i, test.e1, result)
 		}
+		if (warning != "") != test.deprecated {
+			t.Errorf("%v: expected a warning (%v) got (%v)", i, test.deprecated, warning)
+		}
+	}
+}
+
+func TestCommands(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	runner := &fakeRunner{}
+	defer func(r func(*options) Runner) { newRunner = r }(newRunner)
+	newRunner = func(o *options) Runner { return runner }
+
+	run := "agent -t --detailed-exitcodes"
+	tests := []struct {
+		args []string
+		// disabled is the message puppet is disabled with beforehand, or "" if it is enabled
+		disabled string
+		runs     []string
+		fails    bool
+	}{
+		{nil, "", []string{run}, false},
+		{[]string{"run"}, "", []string{run}, false},
+		{[]string{"run", "--noop"}, "", []string{"agent -t --noop --detailed-exitcodes"}, false},
+		{[]string{"-n", "run"}, "", []string{"agent -t --noop --detailed-exitcodes"}, false},
+		{[]string{"run", "-e", "production"}, "", []string{"agent -t --environment production --detailed-exitcodes"}, false},
+		{[]string{"run", "--", "--tags", "nginx"}, "", []string{"agent -t --tags nginx --detailed-exitcodes"}, false},
+		{[]string{"--", "--tags", "nginx"}, "", []string{"agent -t --tags nginx --detailed-exitcodes"}, false},
+		{[]string{"disable", "rack", "move"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"disable", "rack", "move", "--ticket", "OPS-1"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"disable", "--", "-x", "marks", "the", "spot"}, "", []string{`agent --disable "-x marks the spot"`}, false},
+		{[]string{"disable", "upgrading", "--nosilence", "nginx"}, "", []string{`agent --disable "upgrading nginx"`}, false},
+		{[]string{"disable", "upgrading", "-s", "3h", "nginx", "--silence-dry-run"}, "", []string{`agent --disable "upgrading nginx"`}, false},
+		{[]string{"disable", "--ticket=OPS-1", "rack", "--", "--move"}, "", []string{`agent --disable "rack --move"`}, false},
+		{[]string{"disable", "rack", "--bogus"}, "", nil, true},
+		{[]string{"disable", "rack", "--ticket"}, "", nil, true},
+		{[]string{"disable", "--help"}, "", nil, false},
+		{[]string{"--disable", "rack", "move"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"--disable", "-s", "3h", "rack", "move"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"--disable", "--disable-message", "rack move"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"disable", "upgrading"}, "upgrading", nil, true},
+		{[]string{"disable", "--wait", "1m", "upgrading"}, "", nil, true},
+		{[]string{"disable", "--for", "3h", "rack", "move"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"--disable", "rack", "move", "--until", "23:59"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"disable", "--for", "3h", "--until", "23:59", "rack", "move"}, "", nil, true},
+		{[]string{"disable", "--for", "3 hours", "rack", "move"}, "", nil, true},
+		{[]string{"disable", "--for", "30d", "rack", "move"}, "", []string{`agent --disable "rack move"`}, false},
+		{[]string{"enable"}, "upgrading", []string{"agent -t --enable"}, false},
+		{[]string{"--enable"}, "upgrading", []string{"agent -t --enable"}, false},
+		{[]string{"once"}, "upgrading", []string{"agent -t --enable", run, `agent --disable "upgrading"`}, false},
+		{[]string{"--once", "--noop"}, "", []string{"agent -t --noop --detailed-exitcodes"}, false},
+		{[]string{"status"}, "", nil, false},
+		{[]string{"--status"}, "", nil, false},
+		{[]string{"status", "extra"}, "", nil, true},
+		{[]string{"facts"}, "", []string{"facts"}, false},
+		{[]string{"--facts"}, "", []string{"facts"}, false},
+		{[]string{"reap"}, "upgrading", nil, false},
+		{[]string{"reap", "extra"}, "", nil, true},
+		{[]string{"--once", "--enable"}, "", nil, true},
+	}
+	for i, test := range tests {
+		os.Remove(puppetLockFile)
+		if test.disabled != "" {
+			if err := ioutil.WriteFile(puppetLockFile, []byte(`{"disabled_message": "upgrading"}`), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		runner.runs = nil
+		_, err := capturePat(append([]string{"--nosilence"}, test.args...)...)
+		if (err != nil) != test.fails {
+			t.Errorf("%v: expected failure (%v) got (%v)", i, test.fails, err)
+		}
+		if strings.Join(runner.runs, "; ") != strings.Join(test.runs, "; ") {
+			t.Errorf("%v: expected (%v) got (%v)", i, strings.Join(test.runs, "; "), strings.Join(runner.runs, "; "))
+		}
+	}
+}
+
+func TestPuppetFailureExitCode(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	defer func(r func(*options) Runner) { newRunner = r }(newRunner)
+	newRunner = func(o *options) Runner { return &fakeRunner{exits: []int{3}} }
+
+	//Left to cli, puppet's exit status would end the test with os.Exit(3)
+	for i, args := range [][]string{{"facts"}, {"--facts"}} {
+		_, err := capturePat(args...)
+		if code, _ := exitResult(err); code != exitError || !strings.Contains(fmt.Sprint(err), "puppet facts failed") {
+			t.Errorf("%v: expected exit code (%v) got (%v): %v", i, exitError, code, err)
+		}
 	}
 }
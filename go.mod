@@ -6,4 +6,5 @@ require (
 	github.com/akavel/rsrc v0.2.1-0.20170831122431-f6a15ece2cfd
 	github.com/josephspurrier/goversioninfo v0.0.0-20171205053042-0d8781fedde9
 	github.com/urfave/cli v1.20.1-0.20180106191048-75104e932ac2
+	gopkg.in/yaml.v2 v2.4.0
 )
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	silence "github.com/StackExchange/pat/addsilence"
+	"github.com/urfave/cli"
+)
+
+// action names what p was asked to do, as it is recorded in the history.
+// Looking, as pat status and pat facts do, isn't recorded, nor is pat reap
+// finding nothing to do.
+func (p *patCmd) action() string {
+	switch {
+	case p.Status, p.Facts, p.Reap && !p.reaped:
+		return ""
+	case p.Reap:
+		return "reap"
+	case p.Once:
+		return "once"
+	case p.Disable:
+		return "disable"
+	case p.Enable:
+		return "enable"
+	}
+	return "run"
+}
+
+// recordHistory adds what p did, and how it went, to patHistoryFile.
+func (p *patCmd) recordHistory(err error) {
+	action := p.action()
+	if action == "" {
+		return
+	}
+	code, err := exitResult(err)
+	e := &historyEntry{
+		Time:        time.Now().UTC(),
+		Action:      action,
+		Message:     strings.Trim(p.message, "\""),
+		Environment: p.Environment,
+		Noop:        p.Noop,
+		Result:      resultName(code),
+		ExitCode:    code,
+	}
+	if action == "disable" {
+		e.Ticket = p.Ticket
+	}
+	if p.overrode != "" {
+		e.Overrode, e.Reason = p.overrode, p.Reason
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	e.User, _ = silence.RealUser()
+	line, err := json.Marshal(e)
+	if err == nil {
+		err = osAppendStateFile(patHistoryFile, append(line, '\n'))
+	}
+	if err != nil {
+		tsLn("WARNING: Could not record this in the history:", err)
+	}
+}
+
+// resultName says in a word or two what an exit code means.
+func resultName(code int) string {
+	switch {
+	case code == exitOK:
+		return "ok"
+	case code == exitChanges:
+		return "changes"
+	case code == exitFailures:
+		return "failures"
+	case code == exitChangesAndFailures:
+		return "changes and failures"
+	case code == exitRunInProgress:
+		return "run in progress"
+	case code == exitTimeout:
+		return "timed out"
+	case code > 128:
+		return "interrupted"
+	}
+	return "failed"
+}
+
+// getHistory reads patHistoryFile, oldest first. Lines that can't be read
+// are skipped with a warning.
+func getHistory() ([]*historyEntry, error) {
+	contents, err := osReadStateFile(patHistoryFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var history []*historyEntry
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	for n := 1; scanner.Scan(); n++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		e := &historyEntry{}
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			tsLn(fmt.Sprintf("WARNING: %s:%d: %v", patHistoryFile, n, err))
+			continue
+		}
+		history = append(history, e)
+	}
+	return history, scanner.Err()
+}
+
+// historyFilter picks out history entries.
+type historyFilter struct {
+	User   string
+	Action string
+	Since  time.Time
+	Until  time.Time
+}
+
+func (f *historyFilter) matches(e *historyEntry) bool {
+	if f.User != "" && !strings.EqualFold(f.User, e.User) {
+		return false
+	}
+	if f.Action != "" && f.Action != e.Action {
+		return false
+	}
+	if !f.Since.IsZero() && e.Time.Before(f.Since) {
+		return false
+	}
+	if !f.Until.IsZero() && e.Time.After(f.Until) {
+		return false
+	}
+	return true
+}
+
+// CMD: history [--user name] [--action action] [--since time] [--until time]
+func doHistory(c *cli.Context) error {
+	//The config may move the history
+	if _, err := getConfig(c); err != nil {
+		return err
+	}
+	f := &historyFilter{User: c.String("user"), Action: c.String("action")}
+	switch f.Action {
+	case "", "run", "once", "disable", "enable", "reap":
+	default:
+		return fmt.Errorf("unknown --action %q: use run, once, disable, enable or reap", f.Action)
+	}
+	now := time.Now()
+	var err error
+	if c.String("since") != "" {
+		if f.Since, err = silence.ParseAgo(c.String("since"), now); err != nil {
+			return fmt.Errorf("bad --since: %v", err)
+		}
+	}
+	if c.String("until") != "" {
+		if f.Until, err = silence.ParseAgo(c.String("until"), now); err != nil {
+			return fmt.Errorf("bad --until: %v", err)
+		}
+	}
+	format := c.String("format")
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown --format %q: use text or json", format)
+	}
+
+	history, err := getHistory()
+	if err != nil {
+		return err
+	}
+	var matched []*historyEntry
+	for _, e := range history {
+		if f.matches(e) {
+			matched = append(matched, e)
+		}
+	}
+
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range matched {
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if len(matched) == 0 {
+		tsLn("Nothing in the history matches")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tUSER\tACTION\tENVIRONMENT\tRESULT\tMESSAGE")
+	for _, e := range matched {
+		action := e.Action
+		if e.Noop {
+			action += " --noop"
+		}
+		message := e.Message
+		if e.Ticket != "" {
+			message = fmt.Sprintf("%s (%s)", message, e.Ticket)
+		}
+		if e.Overrode != "" {
+			message = fmt.Sprintf("%s [forced over %s's disable: %s]", message, e.Overrode, e.Reason)
+		}
+		if e.Error != "" {
+			message = strings.TrimSpace(message + " " + e.Error)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Local().Format(time.RFC822), e.User, action, e.Environment, e.Result, message)
+	}
+	return w.Flush()
+}
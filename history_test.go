@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHistory(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	defer os.Setenv("SUDO_USER", os.Getenv("SUDO_USER"))
+	os.Setenv("SUDO_USER", "alice")
+
+	for i, o := range []options{
+		{Disable: true, DisableMessage: "rack move", Ticket: "OPS-2"},
+		{Once: true, Environment: "production"},
+		{Enable: true},
+		{Noop: true},
+		{Status: true, Format: "text"},
+		{Facts: true},
+	} {
+		o.NoSilence = true
+		f := &fakeRunner{exits: []int{2, 4}}
+		if o.Noop {
+			f.exits = f.exits[1:]
+		}
+		newPatCmd(&o, f).do()
+		if i == 0 {
+			//A line that can't be read doesn't lose the rest
+			if err := osAppendStateFile(patHistoryFile, []byte("{not json\n")); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	history, err := getHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []historyEntry{
+		{User: "alice", Action: "disable", Message: "rack move", Ticket: "OPS-2", Result: "ok", ExitCode: exitOK},
+		{User: "alice", Action: "once", Message: "rack move", Environment: "production", Result: "changes", ExitCode: exitChanges},
+		{User: "alice", Action: "enable", Message: "rack move", Result: "ok", ExitCode: exitOK},
+		{User: "alice", Action: "run", Noop: true, Result: "failures", ExitCode: exitFailures},
+	}
+	if len(history) != len(expected) {
+		t.Fatalf("expected (%v) entries got (%v): %+v", len(expected), len(history), history)
+	}
+	for i, e := range history {
+		if e.Time.IsZero() {
+			t.Errorf("%v: expected a time", i)
+		}
+		e.Time = expected[i].Time
+		if *e != expected[i] {
+			t.Errorf("%v: expected (%+v) got (%+v)", i, expected[i], *e)
+		}
+	}
+
+	tests := []struct {
+		args     []string
+		expected []string
+		missing  []string
+	}{
+		{nil, []string{"disable", "rack move (OPS-2)", "once", "production", "enable", "run --noop", "failures"}, nil},
+		{[]string{"--action", "disable"}, []string{"rack move (OPS-2)"}, []string{"once", "enable"}},
+		{[]string{"--user", "ALICE", "--since", "1h"}, []string{"disable", "once", "enable"}, nil},
+		{[]string{"--user", "bob"}, []string{"Nothing in the history matches"}, []string{"alice"}},
+		{[]string{"--until", "1h"}, []string{"Nothing in the history matches"}, []string{"alice"}},
+		{[]string{"--action", "enable", "--format", "json"}, []string{`"action":"enable"`, `"user":"alice"`}, []string{`"action":"disable"`}},
+	}
+	for i, test := range tests {
+		out := runPat(t, append([]string{"history"}, test.args...)...)
+		for _, want := range test.expected {
+			if !strings.Contains(out, want) {
+				t.Errorf("%v: expected (%v) in:\n%s", i, want, out)
+			}
+		}
+		for _, unwanted := range test.missing {
+			if strings.Contains(out, unwanted) {
+				t.Errorf("%v: didn't expect (%v) in:\n%s", i, unwanted, out)
+			}
+		}
+	}
+	for i, args := range [][]string{{"--action", "reboot"}, {"--since", "last week"}, {"--format", "xml"}} {
+		if _, err := capturePat(append([]string{"history"}, args...)...); err == nil {
+			t.Errorf("%v: expected %v to be rejected", i, args)
+		}
+	}
+	if contents, _ := ioutil.ReadFile(patHistoryFile); strings.Count(string(contents), "\n") != 5 {
+		t.Errorf("expected 5 lines in the history:\n%s", contents)
+	}
+}
@@ -5,49 +5,213 @@ package main
 import (
 	"fmt"
 	"os"
+	"time"
 
+	silence "github.com/StackExchange/pat/addsilence"
 	"github.com/StackExchange/pat/version"
 	"github.com/urfave/cli"
 )
 
-// preprocessArgs inserts a "--disable-message" flag in front of a bare message.
-func preprocessArgs(items []string) []string {
-	// NOTE(mhenderson): We have an issue with Go flags and the --disable flag. You can specify it like a bool, OR like a string.
-	// Because that doesn't play nicely, we define is solely as a bool in the program, but if we find a string value
-	// after it in the os.Args() then we insert --disable-message before the message,
-	// so that the message itself falls into
-	// a new flag. Gross, I know, but it works.
-	// TODO(tlim): An cleaner way to do this is to process the flags
-	// then let all the remaining arguments be the message.  Remaining arguments
-	// are like the "one", "two", "three" in : cat -v -x one two three
-	//  If --disable-message != "" and len(remaining_args) != 0; error!
-	//  If --disable-message == "", then the message is strings.Join(remaining_args, " ")
-	//  Now if the message is still "", substitute the default message.
-	// If -disable=true, error out if it wasn't the last flag on the command line.
-	// How to get the remaining arguments requires defining a function that
-	// gathers them.  See https://github.com/urfave/cli#arguments
-	var newArgs []string
-	var disabledPosition int
-	for i, v := range items {
-		if v == "--disable" {
-			disabledPosition = i
-		}
-		if i == disabledPosition+1 && string(v[0]) != "-" {
-			newArgs = append(newArgs, "--disable-message", fmt.Sprintf("\"%s\"", v))
-			continue
+// main() executes the application.
+func main() {
+	cli.AppHelpTemplate = fmt.Sprintf(`%s
+		
+SAMPLE USAGE:
+	pat
+	pat run
+		Runs 'puppet agent -t', then sums up what changed or failed.
+		Like puppet's --detailed-exitcodes, exits 0 if nothing changed,
+		2 if there were changes, 4 if there were failures and 6 if
+		both. Exits 1 if the run failed outright.
+
+	pat --wait 10m
+		If puppet is already running, waits up to 10 minutes for that
+		run to finish before starting another. Without --wait, or if
+		it doesn't finish in time, exits 12.
+
+	pat --timeout 30m
+	pat once --timeout 30m
+		Stops puppet, and anything it started, if it runs for longer
+		than 30 minutes, then exits 124. 'pat once' still re-disables
+		and silences.
+
+	pat --retries 3 --retry-delay 1m
+	pat once --retries 3
+		Runs puppet again, up to 3 more times, if a run fails because
+		the puppetserver was unavailable, timed out or reset the
+		connection. Runs where resources failed aren't retried.
+	pat --stderr-style tag
+	pat --stderr-style color
+		Marks the lines puppet prints to stderr with "stderr: ",
+		or shows them in red.
+	pat --noop
+		Runs 'puppet agent -t --noop'
+	pat -e envname
+	pat --env envname
+		Runs 'puppet agent -t --environment envname' 
+	pat run -- --tags nginx
+		Runs 'puppet agent -t --tags nginx'
+	pat facts
+		Runs 'puppet facts'
+
+	pat disable upgrading nginx
+	pat disable
+	pat disable -s 3h
+	pat disable -s "until 17:00" rack move
+	pat disable --ticket OPS-123 upgrading nginx
+		Runs 'puppet --disable' with the rest of the line as the
+		message (after '--' if it starts with '-'), or will prompt
+		for one if left blank.
+		Silences puppet.left.disabled for 1h or the value set by -s,
+		which may be a duration (90m, 3h, 1d) or "until" a local time.
+		Records who disabled puppet, when, the ticket and when puppet
+		is expected back (the end of the silence).
+
+	pat disable --nosilence upgrading nginx
+		Runs 'puppet --disable' but does not silence bosun.
+
+	pat disable --for 3h upgrading nginx
+	pat disable --until 17:00 upgrading nginx
+		Disables puppet, and silences it, for 3 hours or until 17:00.
+		After that, 'pat reap' enables puppet again.
+		A disable longer than the longest silence needs a shorter -s,
+		or --nosilence.
+
+	pat enable
+		Runs 'puppet --enable' and clears the silences set when
+		puppet was disabled.
+		If someone else disabled puppet less than the policy's
+		enable_grace (2h) ago, refuses to.
+
+	pat enable --force --reason "nginx is down"
+		Enables puppet anyway, and records whose disable was
+		overridden, and why, in the history.
+
+	pat once
+		Runs 'puppet agent -t' once.  If Puppet is disabled, it first enables
+		it and the re-disables it (whether puppet ran successfully or not).
+		Exits as 'pat' does.
+		Retains the old disable message and who disabled it.
+		If interrupted (^C or SIGTERM), passes the signal on to puppet
+		and still re-disables it before exiting.
+		Silences puppet.left.disabled for 1h or the value set by -s.
+
+	pat status
+	pat status --format json
+		Reveals whether Puppet is enabled/disabled, and if pat disabled
+		it, who did so, how long ago and when it is expected back.
+		Also shows when puppet last ran, whether it failed, a summary
+		of that run, and whether a run is in progress.
+		Exits 0 if puppet is enabled, 10 if it is disabled and 11 if
+		that can't be told.
+
+	pat reap
+		If a disable with --for or --until has run out, enables puppet,
+		clears its silences and runs it, logging what it did. Otherwise
+		does nothing, quietly. The rpm and deb packages run it every five
+		minutes from /etc/cron.d/pat-reap; otherwise run it from cron:
+		  */5 * * * * root /usr/local/bin/pat reap
+		or a systemd timer (OnCalendar=*:0/5) for a oneshot service.
+		'pat disable --for' and '--until' warn if it hasn't run in the
+		last hour.
+
+	pat silence list
+	pat silence extend 2h
+	pat silence extend until 17:00
+	pat silence clear
+		Shows, extends or removes the silences on this host. Silences that
+		also cover other hosts (host=web*, host=web01|db01) are only shown,
+		unless pat set them.
+
+	pat logs
+	pat logs --last
+	pat logs pat-20200102-150405.000000-1234.log
+		Lists the runs logged in the --log-dir, or shows what one of
+		them printed. The log starts with who ran pat, how, and which
+		version, and ends with the exit code. Only the latest
+		--log-keep logs are kept. 'pat status' isn't logged.
+
+	pat history
+	pat history --action disable --since 7d
+	pat history --user alice --since 2020-01-02 --until 2020-01-03
+	pat history --format json
+		Shows each time pat ran, enabled or disabled puppet: when,
+		who (the user behind sudo), the message, environment, --noop
+		and how it went.
+
+	pat config show
+		Shows the settings in effect, from the config files, $PAT_*
+		environment variables and flags (see NOTES).
+
+NOTES:
+	* %s
+	* If you want to add regular "puppet agent" flags, add them after '--'.
+	* Flags may be given before the command or after it. The old flags
+	  --disable [message], --enable, --once, --status and --facts still
+	  work, but are deprecated in favor of the commands.
+	* No silence is set if --noop is set; instead, like --silence-dry-run,
+	  pat shows the request it would have sent.
+	* Silences go to Bosun unless --silencer (or $PAT_SILENCER) says
+	  alertmanager or webhook, at the --silence-url (or $PAT_SILENCE_URL).
+	* Unless --state-dir (or state_dir in the config) says otherwise, pat
+	  asks puppet where its state is ('puppet config print'), and keeps
+	  the answer in %s until puppet or
+	  its puppet.conf changes; users who can't write there keep their own
+	  copy in their cache directory. If puppet isn't at the default
+	  --puppet-bin, pat looks for it on the PATH.
+	* Settings are read from %s, then your own
+	  --user-config (%s), then $PAT_* environment
+	  variables, then flags. 'pat config show' shows the result. For example:
+	    puppet:
+	      bin: /opt/puppetlabs/bin/puppet
+	      state_dir: /opt/puppetlabs/puppet/cache/state
+	      environment: production
+	    silence:
+	      duration: 2h
+	      url: https://bosun.example.com
+	      ca_file: /etc/pki/internal-ca.pem
+	      token: s3cret
+	      timeout: 10s
+	      max_duration: 72h
+	      fqdn: true
+	      hosts: [web01, web01.example.com]
+	      tags: [cluster=ny]
+	    messages:
+	      disable: "{{"{{.Name}}"}} is working on {{"{{.Host}}"}}, back in {{"{{.Duration}}"}}"
+	      silence: "{{"{{.Message}}"}} ({{"{{.Ticket}}"}})"
+	    policy:
+	      enable_grace: 2h
+	    flags:
+	      retries: 2
+	      timeout: 30m
+	  The messages may also use {{"{{.User}}"}}. Under "flags", any other flag
+	  may be given a default. Only the system config may set the policy.
+	  Config files that others than root and their owner may change are
+	  ignored.
+`, cli.AppHelpTemplate, osRootMessage, puppetCacheFile, systemConfigFile, userConfigFile)
+
+	pat := newApp()
+	args, warning := legacyArgs(os.Args, boolFlagNames(pat.Flags))
+	if warning != "" {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+	err := pat.Run(args)
+	if err != nil {
+		code, err := exitResult(err)
+		if err != nil {
+			fmt.Println(err)
 		}
-		newArgs = append(newArgs, v)
+		os.Exit(code)
 	}
-	return newArgs
 }
 
-// main() sets up the application and executes it. The rest of the work is in pat.go
-func main() {
+// newApp() sets up the application. The rest of the work is in pat.go
+func newApp() *cli.App {
 	pat := cli.NewApp()
 	pat.Name = "pat"
 	pat.Usage = "A wrapper for \"puppet agent -t\" (hence the name: P... A... T) that enforces rules about disable messages and so on"
 	pat.Version = version.GetVersionInfo()
-	pat.UsageText = fmt.Sprintf("%s [flags] [additional puppet commands]", os.Args[0])
+	pat.UsageText = fmt.Sprintf("%s [flags] [command] [command flags] [arguments]", os.Args[0])
 	pat.Authors = []cli.Author{
 		cli.Author{
 			Name:  "Tom Limoncelli",
@@ -59,28 +223,62 @@ func main() {
 		},
 	}
 	pat.Flags = []cli.Flag{
-		cli.BoolFlag{
-			Name:  "disable",
-			Usage: "Disable puppet runs",
+		cli.StringFlag{
+			Name:  "ticket",
+			Usage: "Ticket to record with disable, shown by status",
 		},
 		cli.StringFlag{
-			Name:   "disable-message",
-			Value:  "",
-			Usage:  "The reason why puppet is being disabled",
-			Hidden: true,
+			Name:  "for",
+			Usage: "With disable, have pat reap enable puppet again after [value] (90m, 3h, 1d)",
+		},
+		cli.StringFlag{
+			Name:  "until",
+			Usage: "With disable, have pat reap enable puppet again at [value], a local time (17:00, 2006-01-02 15:04)",
 		},
-
 		cli.BoolFlag{
-			Name:  "enable",
-			Usage: "Enable puppet runs",
+			Name:  "force",
+			Usage: "Enable puppet even though someone else disabled it recently (needs --reason)",
+		},
+		cli.StringFlag{
+			Name:  "reason",
+			Usage: "Why --force is needed, recorded in the history",
+		},
+		cli.DurationFlag{
+			Name:  "wait",
+			Usage: "If puppet is already running, wait up to [value] for it to finish",
+		},
+		cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "Stop puppet if it runs for longer than [value]",
+		},
+		cli.IntFlag{
+			Name:  "retries",
+			Usage: "Run puppet up to [value] more times if a run fails for a passing reason, like the puppetserver restarting",
+		},
+		cli.DurationFlag{
+			Name:  "retry-delay",
+			Value: 30 * time.Second,
+			Usage: "How long to wait before running puppet again",
+		},
+		cli.StringFlag{
+			Name:   "stderr-style",
+			Value:  "plain",
+			Usage:  "How to show what puppet prints to stderr: plain, tag or color",
+			EnvVar: "PAT_STDERR_STYLE",
 		},
 		cli.BoolFlag{
-			Name:  "once",
-			Usage: "Run puppet. If puppet was disabled, re-disable when done",
+			Name:  "nosilence",
+			Usage: "Do not set a silence when disabling puppet",
 		},
 		cli.BoolFlag{
-			Name:  "status",
-			Usage: "Report disable status",
+			Name:   "silence-dry-run",
+			Usage:  "Show the silence that would be set, without setting it (implied by --noop)",
+			EnvVar: "PAT_SILENCE_DRY_RUN",
+		},
+		cli.StringFlag{
+			Name:  "format",
+			Value: "text",
+			Usage: "Output format for status: text or json",
 		},
 		cli.BoolFlag{
 			Name:  "noop, n",
@@ -103,53 +301,200 @@ func main() {
 			Usage: "Pass --server [value] flag to puppet",
 		},
 		cli.StringFlag{
-			Name:  "environment, env, e",
-			Usage: "Pass --environment flag to puppet",
+			Name:   "environment, env, e",
+			Usage:  "Pass --environment flag to puppet",
+			EnvVar: "PAT_ENVIRONMENT",
+		},
+		cli.StringFlag{
+			Name:   "s",
+			Value:  "1h",
+			Usage:  "Set the silence duration to [value]",
+			EnvVar: "PAT_SILENCE_DURATION",
+		},
+		cli.StringFlag{
+			Name:   "silencer",
+			Value:  "bosun",
+			Usage:  "Where to set silences: bosun, alertmanager or webhook",
+			EnvVar: "PAT_SILENCER",
+		},
+		cli.StringFlag{
+			Name:   "silence-url",
+			Usage:  "URL of the silencer (for bosun, defaults to https://bosun)",
+			EnvVar: "PAT_SILENCE_URL",
+		},
+		cli.StringFlag{
+			Name:   "silence-ca",
+			Usage:  "PEM file of extra CAs to trust when talking to the silencer",
+			EnvVar: "PAT_SILENCE_CA",
+		},
+		cli.StringFlag{
+			Name:   "silence-cert",
+			Usage:  "Client certificate to present to the silencer",
+			EnvVar: "PAT_SILENCE_CERT",
+		},
+		cli.StringFlag{
+			Name:   "silence-key",
+			Usage:  "Key for --silence-cert",
+			EnvVar: "PAT_SILENCE_KEY",
+		},
+		cli.StringFlag{
+			Name:   "silence-token",
+			Usage:  "Bearer token to send to the silencer",
+			EnvVar: "PAT_SILENCE_TOKEN",
+		},
+		cli.StringFlag{
+			Name:   "silence-user",
+			Usage:  "Basic auth user for the silencer",
+			EnvVar: "PAT_SILENCE_USER",
+		},
+		cli.StringFlag{
+			Name:   "silence-password",
+			Usage:  "Basic auth password for the silencer",
+			EnvVar: "PAT_SILENCE_PASSWORD",
 		},
 		cli.BoolFlag{
-			Name:  "facts",
-			Usage: "Run puppet facts instead of puppet agent",
+			Name:   "silence-fqdn",
+			Usage:  "Silence this host by its FQDN rather than its shortname",
+			EnvVar: "PAT_SILENCE_FQDN",
+		},
+		cli.StringSliceFlag{
+			Name:   "silence-host",
+			Usage:  "Silence this name instead of this host's (may be repeated)",
+			EnvVar: "PAT_SILENCE_HOSTS",
+		},
+		cli.StringSliceFlag{
+			Name:   "silence-tag",
+			Usage:  "Only silence alerts that also have this key=value tag (may be repeated)",
+			EnvVar: "PAT_SILENCE_TAGS",
+		},
+		cli.DurationFlag{
+			Name:   "silence-max",
+			Value:  silence.MaxDuration,
+			Usage:  "The longest silence that may be set",
+			EnvVar: "PAT_SILENCE_MAX",
+		},
+		cli.DurationFlag{
+			Name:   "silence-timeout",
+			Value:  silence.DefaultTimeout,
+			Usage:  "How long to wait for the silencer",
+			EnvVar: "PAT_SILENCE_TIMEOUT",
+		},
+		cli.StringFlag{
+			Name:   "log-dir",
+			Value:  logDir,
+			Usage:  "Where to keep a log of each run. Empty to not log runs",
+			EnvVar: "PAT_LOG_DIR",
+		},
+		cli.IntFlag{
+			Name:   "log-keep",
+			Value:  50,
+			Usage:  "How many run logs to keep. 0 keeps them all",
+			EnvVar: "PAT_LOG_KEEP",
+		},
+		cli.StringFlag{
+			Name:   "puppet-bin",
+			Value:  puppetBinPath,
+			Usage:  "The puppet command",
+			EnvVar: "PAT_PUPPET_BIN",
+		},
+		cli.StringFlag{
+			Name:   "state-dir",
+			Usage:  "Where puppet keeps its state, and pat its own (default: ask puppet)",
+			EnvVar: "PAT_STATE_DIR",
+		},
+		cli.StringFlag{
+			Name:   "config",
+			Value:  systemConfigFile,
+			Usage:  "System-wide config file with defaults for pat's settings",
+			EnvVar: "PAT_CONFIG",
+		},
+		cli.StringFlag{
+			Name:   "user-config",
+			Value:  userConfigFile,
+			Usage:  "Your own config file, which takes precedence over --config. Empty to not read one",
+			EnvVar: "PAT_USER_CONFIG",
 		},
 	}
-	cli.AppHelpTemplate = fmt.Sprintf(`%s
-		
-SAMPLE USAGE:
-	pat
-		Runs 'puppet agent -t'
-	pat --noop
-		Runs 'puppet agent -t --noop'
-	pat -e envname
-	pat --env envname
-		Runs 'puppet agent -t --environment envname' 
-
-	pat --disable message
-	pat --disable
-	pat -s 3h --disable
-		Runs 'puppet --disable' with message, or will prompt for one
-		if left blank.
-		Silences puppet.left.disabled for 1h or the value set by -s.
-
-	pat --enable
-		Runs 'puppet --enable'
-
-	pat --once
-		Runs 'puppet agent -t' once.  If Puppet is disabled, it first enables
-		it and the re-disables it (whether puppet ran successfully or not).
-		Retains the old disable message.
-		Silences puppet.left.disabled for 1h or the value set by -s.
-
-	pat --status
-		Reveals whether Puppet is enabled/disabled.
-
-NOTES:
-	* %s
-	* If you want to add regular "puppet agent" flags, add them after '--'.
-`, cli.AppHelpTemplate, osRootMessage)
+	pat.Commands = append(newCommands(pat.Flags), []cli.Command{
+		{
+			Name:  "silence",
+			Usage: "List, extend or clear the silences on this host",
+			Subcommands: []cli.Command{
+				{
+					Name:   "list",
+					Usage:  "Show the active and pending silences on this host",
+					Action: doSilenceList,
+				},
+				{
+					Name:      "extend",
+					Usage:     "Make the silences on this host end later, but not those that also cover other hosts",
+					ArgsUsage: "<duration>",
+					Action:    doSilenceExtend,
+				},
+				{
+					Name:   "clear",
+					Usage:  "Remove the silences on this host, but not those that also cover other hosts",
+					Action: doSilenceClear,
+				},
+			},
+		},
+		{
+			Name:      "logs",
+			Usage:     "List the logged runs, or show one",
+			ArgsUsage: "[file]",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "last",
+					Usage: "Show the log of the latest run",
+				},
+			},
+			Action: doLogs,
+		},
+		{
+			Name:  "history",
+			Usage: "Show who ran, enabled or disabled puppet with pat, and how it went",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "user",
+					Usage: "Only show what this user did",
+				},
+				cli.StringFlag{
+					Name:  "action",
+					Usage: "Only show this action: run, once, disable, enable or reap",
+				},
+				cli.StringFlag{
+					Name:  "since",
+					Usage: "Only show what happened since this long ago (7d, 36h) or this local time (2006-01-02 15:04)",
+				},
+				cli.StringFlag{
+					Name:  "until",
+					Usage: "Only show what happened until this long ago or this local time",
+				},
+				cli.StringFlag{
+					Name:  "format",
+					Value: "text",
+					Usage: "Output format: text or json (a line per entry)",
+				},
+			},
+			Action: doHistory,
+		},
+		{
+			Name:  "config",
+			Usage: "Show pat's settings",
+			Subcommands: []cli.Command{
+				{
+					Name:   "show",
+					Usage:  "Show the settings from the config files, environment variables and flags",
+					Action: doConfigShow,
+				},
+			},
+		},
+	}...)
 
+	pat.Before = setupConfig
 	pat.Action = doPat
-	err := pat.Run(preprocessArgs(os.Args))
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
-	}
+	//main decides how pat exits, not cli, which would exit with the status of
+	//any command that failed, such as puppet's
+	pat.ExitErrHandler = func(*cli.Context, error) {}
+	return pat
 }
@@ -1,5 +1,99 @@
 package main
 
+import "time"
+
 type disabledMessage struct {
 	DisabledMessage string `json:"disabled_message"`
 }
+
+// disableRecord is what pat knows about why puppet is disabled. Puppet itself
+// only keeps the message, so pat writes the rest to patDisableFile.
+type disableRecord struct {
+	Message        string     `json:"message,omitempty"`
+	User           string     `json:"user,omitempty"`
+	SudoUser       string     `json:"sudo_user,omitempty"`
+	DisabledAt     time.Time  `json:"disabled_at"`
+	ExpectedEnable *time.Time `json:"expected_enable,omitempty"`
+	Ticket         string     `json:"ticket,omitempty"`
+	SilenceIDs     []string   `json:"silence_ids,omitempty"`
+	// NoSilence is set when pat was told not to silence the alert, so that
+	// there is nothing to clear.
+	NoSilence bool `json:"no_silence,omitempty"`
+	// ReenableAt is when a disable with --for or --until runs out, and pat
+	// reap enables puppet again.
+	ReenableAt *time.Time `json:"reenable_at,omitempty"`
+}
+
+// historyEntry is a line of patHistoryFile: something pat was asked to do,
+// and how it went.
+type historyEntry struct {
+	Time        time.Time `json:"time"`
+	User        string    `json:"user"`
+	Action      string    `json:"action"`
+	Message     string    `json:"message,omitempty"`
+	Ticket      string    `json:"ticket,omitempty"`
+	Environment string    `json:"environment,omitempty"`
+	Noop        bool      `json:"noop,omitempty"`
+	Result      string    `json:"result"`
+	ExitCode    int       `json:"exit_code"`
+	Error       string    `json:"error,omitempty"`
+	// Overrode is the user whose disable was enabled with --force, for Reason.
+	Overrode string `json:"overrode,omitempty"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// lastRunSummary is the part of puppet's last_run_summary.yaml that pat uses.
+type lastRunSummary struct {
+	Version     summaryVersion     `yaml:"version" json:"version"`
+	Application summaryApplication `yaml:"application" json:"application"`
+	// Resources and Events are missing if puppet didn't get as far as
+	// applying a catalog.
+	Resources *summaryResources `yaml:"resources" json:"resources,omitempty"`
+	Events    *summaryEvents    `yaml:"events" json:"events,omitempty"`
+	Time      summaryTime       `yaml:"time" json:"time"`
+}
+
+type summaryVersion struct {
+	Config string `yaml:"config" json:"config"`
+	Puppet string `yaml:"puppet" json:"puppet"`
+}
+
+type summaryApplication struct {
+	InitialEnvironment   string `yaml:"initial_environment" json:"initial_environment,omitempty"`
+	ConvergedEnvironment string `yaml:"converged_environment" json:"converged_environment,omitempty"`
+}
+
+type summaryResources struct {
+	Changed         int `yaml:"changed" json:"changed"`
+	Failed          int `yaml:"failed" json:"failed"`
+	FailedToRestart int `yaml:"failed_to_restart" json:"failed_to_restart"`
+	OutOfSync       int `yaml:"out_of_sync" json:"out_of_sync"`
+	Restarted       int `yaml:"restarted" json:"restarted"`
+	Total           int `yaml:"total" json:"total"`
+}
+
+type summaryEvents struct {
+	Failure int `yaml:"failure" json:"failure"`
+}
+
+type summaryTime struct {
+	LastRun int64   `yaml:"last_run" json:"last_run"`
+	Total   float64 `yaml:"total" json:"total"`
+}
+
+// lastRunReport is the part of puppet's last_run_report.yaml that pat uses.
+type lastRunReport struct {
+	Status           string                    `yaml:"status"`
+	Logs             []reportLog               `yaml:"logs"`
+	ResourceStatuses map[string]reportResource `yaml:"resource_statuses"`
+}
+
+type reportLog struct {
+	Level   string `yaml:"level"`
+	Source  string `yaml:"source"`
+	Message string `yaml:"message"`
+}
+
+type reportResource struct {
+	Failed bool `yaml:"failed"`
+}
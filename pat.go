@@ -4,71 +4,163 @@ import (
 	"bufio"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"os/user"
+	"path/filepath"
 	"strings"
+	"syscall"
+	"text/template"
 	"time"
 
+	silence "github.com/StackExchange/pat/addsilence"
 	"github.com/urfave/cli"
 )
 
+// isTimestamp is whether tsLn and tsPrintf put timestamps on what they print.
+var isTimestamp = false
+
+// options are what pat has been asked to do, from its flags.
+type options struct {
+	// PuppetArgs are added to every puppet command: the flags that pass
+	// through to puppet, and anything after '--'.
+	PuppetArgs []string
+
+	Status         bool
+	Format         string
+	Once           bool
+	Disable        bool
+	DisableMessage string
+	// DisableUntil is how long to disable for, as silence.ParseDeadline takes it,
+	// if puppet is to be enabled again by pat reap.
+	DisableUntil string
+	Enable       bool
+	Reap         bool
+	// Force enables puppet even within someone else's EnableGrace, for Reason.
+	Force       bool
+	Reason      string
+	EnableGrace time.Duration
+
+	Debug       bool
+	Noop        bool
+	Facts       bool
+	Environment string
+	Wait        time.Duration
+	Timeout     time.Duration
+	Retries     int
+	RetryDelay  time.Duration
+	// StderrStyle is how puppet's stderr is shown: plain, tag or color.
+	StderrStyle string
+
+	NoSilence       bool
+	SilenceDryRun   bool
+	SilenceDuration string
+	SilenceHosts    []string
+	SilenceTags     string
+	Ticket          string
+
+	// DisableTemplate and SilenceTemplate are the message templates from
+	// the config.
+	DisableTemplate string
+	SilenceTemplate string
+}
+
+// silenceAlert is the alert that fires when puppet is left disabled.
+const silenceAlert = "puppet.left.disabled"
+
+// Where puppet keeps its state, and pat its own alongside. See setStateDir.
 var (
-	additionalArguments = []string{}
-	isDebug             = false
-	isTimestamp         = false
-	isNoop              = false
-	isFacts             = false
-	puppetDisabled      = false
+	puppetLockFile    = osPuppetLockFile
+	puppetLastRunFile = filepath.Join(filepath.Dir(osPuppetLockFile), "last_run_summary.yaml")
+	puppetRunLockFile = filepath.Join(filepath.Dir(osPuppetLockFile), "agent_catalog_run.lock")
+	puppetReportFile  = filepath.Join(filepath.Dir(osPuppetLockFile), "last_run_report.yaml")
+	// patDisableFile holds the disableRecord for the current disable,
+	// including the IDs of the silences that pat enable should clear again.
+	patDisableFile = filepath.Join(filepath.Dir(osPuppetLockFile), "pat_disabled.json")
+	// patHistoryFile has a historyEntry per line for each time pat enabled,
+	// disabled or ran puppet.
+	patHistoryFile = filepath.Join(filepath.Dir(osPuppetLockFile), "pat_history.jsonl")
+	// patReapFile has when pat reap last ran, so that disable --for and
+	// --until can warn if nothing is running it.
+	patReapFile = filepath.Join(filepath.Dir(osPuppetLockFile), "pat_reaped")
 )
 
+// setStateDir points pat at puppet's state in dir.
+func setStateDir(dir string) {
+	puppetLockFile = filepath.Join(dir, "agent_disabled.lock")
+	puppetLastRunFile = filepath.Join(dir, "last_run_summary.yaml")
+	puppetRunLockFile = filepath.Join(dir, "agent_catalog_run.lock")
+	puppetReportFile = filepath.Join(dir, "last_run_report.yaml")
+	patDisableFile = filepath.Join(dir, "pat_disabled.json")
+	patHistoryFile = filepath.Join(dir, "pat_history.jsonl")
+	patReapFile = filepath.Join(dir, "pat_reaped")
+}
+
+// patCmd does what pat has been asked to, running puppet with runner.
+type patCmd struct {
+	*options
+	runner Runner
+	// disabled is whether puppet is disabled.
+	disabled bool
+	// signals, while set, receives the signals to pass on to puppet.
+	signals chan os.Signal
+	// message is the disable message that was set or cleared, for the history.
+	message string
+	// overrode is the user whose disable was forced open, for the history.
+	overrode string
+	// reaped is whether pat reap found a disable that had run out.
+	reaped bool
+}
+
+func newPatCmd(o *options, r Runner) *patCmd {
+	p := &patCmd{options: o, runner: r}
+	//Check if puppet is currently disabled
+	if _, err := os.Stat(puppetLockFile); err == nil {
+		p.disabled = true
+	}
+	return p
+}
+
+// CMD: pat [flags] [-- puppet flags], which is the same as pat run
 func doPat(pat *cli.Context) error {
-	//Throw these as globals as they're used all over the place. Saves us from passing pat through everywhere.
-	additionalArguments = pat.Args()
+	return startPat(pat, "run", pat.Args())
+}
 
-	//We need some additional arguments for dealing with things like the verbose and debug flags
-	additionalArguments = pat.Args()
-	var flagArguments []string
+// startPat does what command (run, disable, enable, once, status, facts or reap)
+// says, with args after the command's name.
+func startPat(pat *cli.Context, command string, args []string) error {
 	if pat.Bool("timestamp") {
 		isTimestamp = true
 	}
-	if pat.Bool("noop") {
-		tsLn("NOOP mode enabled")
-		isNoop = true
-		flagArguments = append(flagArguments, "--noop")
-	}
-	if pat.Bool("debug") {
-		isDebug = true
-		flagArguments = append(flagArguments, "--debug")
-	}
-	if pat.Bool("facts") {
-		isFacts = true
-	}
-	if pat.Bool("verbose") {
-		flagArguments = append(flagArguments, "--verbose")
-	}
-	if pat.Bool("verbose") {
-		flagArguments = append(flagArguments, "--verbose")
-	}
-	if pat.IsSet("environment") {
-		flagArguments = append(flagArguments, "--environment", pat.String("environment"))
+	o, err := newOptions(pat, command, args)
+	if err != nil {
+		return err
 	}
-	if pat.IsSet("server") {
-		flagArguments = append(flagArguments, "--server", pat.String("server"))
+	//pat status only looks, and pat reap mostly finds nothing to do, so
+	//neither is logged unless there is something to do
+	var log io.WriteCloser
+	if !o.Status && (!o.Reap || reapDue(time.Now()) != nil) {
+		log, err = openRunLog(pat)
+		if err != nil {
+			tsLn("WARNING: not logging this run:", err)
+		}
+		if log != nil {
+			runLog = log
+		}
 	}
-	additionalArguments = append(flagArguments, additionalArguments...)
-
-	//Check if puppet is currently disabled
-	if _, err := os.Stat(osPuppetLockFile); err == nil {
-		puppetDisabled = true
+	if o.Noop {
+		tsLn("NOOP mode enabled")
 	}
+	p := newPatCmd(o, newRunner(o))
 
-	if isDebug {
+	if o.Debug {
 		tsLn("DEBUG: -- Flags --")
-		tsLn("DEBUG: disable:", pat.String("disable"))
-		tsLn("DEBUG: enable:", pat.Bool("enable"))
-		tsLn("DEBUG: once:", pat.Bool("once"))
-		tsLn("DEBUG: status:", pat.Bool("status"))
+		tsLn("DEBUG: command:", command)
+		tsLn("DEBUG: disable message:", o.DisableMessage)
+		tsLn("DEBUG: nosilence:", pat.Bool("nosilence"))
+		tsLn("DEBUG: silence-dry-run:", pat.Bool("silence-dry-run"))
 		tsLn("DEBUG: noop:", pat.Bool("noop"))
 		tsLn("DEBUG: debug:", pat.Bool("debug"))
 		tsLn("DEBUG: timestamp:", pat.Bool("timestamp"))
@@ -76,101 +168,386 @@ func doPat(pat *cli.Context) error {
 		tsLn("DEBUG: server:", pat.String("server"))
 		tsLn("DEBUG: environment:", pat.String("environment"))
 		tsLn("DEBUG: s:", pat.String("s"))
+		tsLn("DEBUG: silencer:", pat.String("silencer"))
+		tsLn("DEBUG: silence-url:", pat.String("silence-url"))
+		tsLn("DEBUG: config:", pat.String("config"))
+		tsLn("DEBUG: ticket:", pat.String("ticket"))
+		tsLn("DEBUG: format:", pat.String("format"))
+		tsLn("DEBUG: wait:", pat.Duration("wait"))
+		tsLn("DEBUG: timeout:", pat.Duration("timeout"))
+		tsLn("DEBUG: retries:", pat.Int("retries"))
+		tsLn("DEBUG: retry-delay:", pat.Duration("retry-delay"))
+		tsLn("DEBUG: stderr-style:", pat.String("stderr-style"))
+		tsLn("DEBUG: silenceTags:", o.SilenceTags)
 
 		tsLn("DEBUG: -- OS --")
 		tsLn("DEBUG: osRootName:", osRootName)
 		tsLn("DEBUG: osRootMessage:", osRootMessage)
 		tsLn("DEBUG: osPuppetLockFile:", osPuppetLockFile)
-		tsLn("DEBUG: osPuppetBinPath:", osPuppetBinPath)
+		tsLn("DEBUG: puppetLockFile:", puppetLockFile)
+		tsLn("DEBUG: puppetBinPath:", puppetBinPath)
 
 		tsLn("DEBUG: -- PROGRAM --")
-		tsLn("DEBUG: puppetDisabled:", puppetDisabled)
-		tsLn("DEBUG: additionalArgs:", additionalArguments)
+		tsLn("DEBUG: puppetDisabled:", p.disabled)
+		tsLn("DEBUG: additionalArgs:", o.PuppetArgs)
 	}
 
-	var err error
+	err = p.do()
+	if log != nil {
+		closeRunLog(log, err)
+	}
+	return err
+}
 
-	// CMD: --status
-	if pat.Bool("status") {
-		if puppetDisabled {
-			disabledMessage, err := getPuppetDisabledMessage()
-			if err != nil {
-				return err
-			}
-			tsLn("STATUS: PUPPET IS DISABLED")
-			tsLn("DISABLE MESSAGE: ", disabledMessage)
-			return nil
+// newOptions reads pat's flags and config, and sets up the silencer.
+func newOptions(pat *cli.Context, command string, args []string) (*options, error) {
+	config, err := getConfig(pat)
+	if err != nil {
+		return nil, err
+	}
+	o := &options{
+		Status:          command == "status",
+		Format:          pat.String("format"),
+		Once:            command == "once",
+		Disable:         command == "disable",
+		Enable:          command == "enable",
+		Reap:            command == "reap",
+		Force:           pat.Bool("force"),
+		Reason:          pat.String("reason"),
+		EnableGrace:     config.Policy.EnableGrace,
+		Debug:           pat.Bool("debug"),
+		Noop:            pat.Bool("noop"),
+		Facts:           command == "facts",
+		Environment:     config.Puppet.Environment,
+		Wait:            pat.Duration("wait"),
+		Timeout:         pat.Duration("timeout"),
+		Retries:         pat.Int("retries"),
+		RetryDelay:      pat.Duration("retry-delay"),
+		StderrStyle:     pat.String("stderr-style"),
+		NoSilence:       pat.Bool("nosilence"),
+		SilenceDryRun:   pat.Bool("silence-dry-run"),
+		SilenceDuration: config.Silence.Duration,
+		Ticket:          pat.String("ticket"),
+		DisableTemplate: config.Messages.Disable,
+		SilenceTemplate: config.Messages.Silence,
+	}
+	if _, ok := stderrStyles[o.StderrStyle]; !ok {
+		return nil, fmt.Errorf("unknown --stderr-style %q: use plain, tag or color", o.StderrStyle)
+	}
+	o.SilenceHosts, o.SilenceTags, err = setupSilencer(pat)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case o.Disable:
+		//Everything after "pat disable" is the message
+		o.DisableMessage = strings.Join(args, " ")
+		args = nil
+	case (o.Status || o.Reap) && len(args) > 0:
+		return nil, fmt.Errorf("pat %s takes no arguments, got %q", command, strings.Join(args, " "))
+	}
+	if o.Disable {
+		switch {
+		case pat.IsSet("for") && pat.IsSet("until"):
+			return nil, fmt.Errorf("use --for or --until, not both")
+		case pat.IsSet("for"):
+			o.DisableUntil = pat.String("for")
+		case pat.IsSet("until"):
+			o.DisableUntil = "until " + pat.String("until")
+		}
+		//Silence for as long as puppet is to be disabled, unless told otherwise
+		if o.DisableUntil != "" && !pat.IsSet("s") {
+			o.SilenceDuration = o.DisableUntil
 		}
-		tsLn("STATUS: PUPPET IS ENABLED")
-		return nil
 	}
 
-	// CMD: --once
-	if pat.Bool("once") {
+	//We need some additional arguments for dealing with things like the verbose and debug flags
+	var flagArguments []string
+	if o.Noop {
+		flagArguments = append(flagArguments, "--noop")
+	}
+	if o.Debug {
+		flagArguments = append(flagArguments, "--debug")
+	}
+	if pat.Bool("verbose") {
+		flagArguments = append(flagArguments, "--verbose")
+	}
+	if o.Environment != "" {
+		flagArguments = append(flagArguments, "--environment", o.Environment)
+	}
+	if pat.IsSet("server") {
+		flagArguments = append(flagArguments, "--server", pat.String("server"))
+	}
+	o.PuppetArgs = append(flagArguments, args...)
+	return o, nil
+}
+
+// do carries out the command pat was given, and records it in the history.
+func (p *patCmd) do() error {
+	err := p.doAction()
+	p.recordHistory(err)
+	return err
+}
+
+func (p *patCmd) doAction() error {
+	var err error
+	// Check the silence duration now, rather than after puppet has been disabled
+	if p.Disable && p.DisableUntil != "" {
+		if _, err := silence.ParseDeadline(p.DisableUntil, time.Now()); err != nil {
+			return fmt.Errorf("bad --for or --until: %v", err)
+		}
+	}
+	if (p.Disable || p.Once) && !p.NoSilence {
+		_, err := silence.ParseEnd(p.SilenceDuration, time.Now())
+		switch {
+		case err != nil && p.Disable && p.SilenceDuration == p.DisableUntil:
+			//The silence lasts as long as the disable unless -s says otherwise
+			return fmt.Errorf("can't silence for as long as --for or --until (%v); give a shorter -s, or --nosilence", err)
+		case err != nil:
+			return fmt.Errorf("bad silence duration (-s): %v", err)
+		}
+	}
+
+	// CMD: status
+	if p.Status {
+		return doStatus(p.Format)
+	}
+
+	// CMD: reap
+	if p.Reap {
+		return p.reap(time.Now())
+	}
+
+	// CMD: once
+	if p.Once {
+		//Don't enable puppet only to find that a run is already in progress
+		err = waitForRun(p.Wait)
+		if err != nil {
+			return err
+		}
+		//Dying to ^C would leave puppet enabled, so catch signals instead, and
+		//re-disable before exiting
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(signals)
+		defer func() { p.signals = nil }()
 		var disabledMessage string
+		var disabledRecord *disableRecord
 		var puppetWasDisabled bool
 		//If puppet is disabled; enable it
-		if puppetDisabled {
+		if p.disabled {
 			puppetWasDisabled = true
 			disabledMessage, err = getPuppetDisabledMessage()
 			if err != nil {
 				return err
 			}
-			err = enablePuppet()
+			p.message = disabledMessage
+			//Keep who disabled it and when, rather than making it look like we did
+			disabledRecord, err = getDisableRecord()
+			if err != nil || !disabledRecord.matches(disabledMessage) {
+				disabledRecord = nil
+			}
+			err = p.enablePuppet()
 			if err != nil {
+				//Puppet may have got as far as removing its lock before it was stopped
+				if _, statErr := os.Stat(puppetLockFile); os.IsNotExist(statErr) {
+					p.disabled = false
+					if disableErr := p.redisablePuppet(disabledMessage, disabledRecord); disableErr != nil {
+						tsLn("WARNING: Puppet was left enabled:", disableErr)
+					}
+				}
 				return err
 			}
 		}
 
+		//Only puppet runs are passed signals: one caught before now is still
+		//waiting, and stops the run as soon as it starts
+		p.signals = signals
 		//Do a default run
-		execPuppet()
+		runErr := p.runPuppet()
+		//Whatever happens now, puppet has to be re-disabled
+		p.signals = nil
 
 		//If puppet was disabled; disable it again
 		if puppetWasDisabled {
-			err = disablePuppet(disabledMessage)
+			err = p.redisablePuppet(disabledMessage, disabledRecord)
 			if err != nil {
 				return err
 			}
 		}
 
-		return nil
+		return runErr
 
 	}
 
-	// CMD: --disable [message]
-	if pat.IsSet("disable") {
-		err = disablePuppet(pat.String("disable-message"))
+	// CMD: disable [message...]
+	if p.Disable {
+		if p.DisableUntil != "" && !reaperRunning(time.Now()) {
+			tsLn("WARNING: pat reap hasn't run in the last hour, so nothing may enable puppet again; see 'pat help' for how to run it")
+		}
+		err = p.disablePuppet(p.DisableMessage, nil)
 		return err
 	}
 
-	// CMD: --enable
-	if pat.IsSet("enable") {
-		err = enablePuppet()
-		return err
+	// CMD: enable
+	if p.Enable {
+		if p.disabled {
+			p.message, _ = getPuppetDisabledMessage()
+		}
+		err = p.checkEnable(time.Now())
+		if err != nil {
+			return err
+		}
+		err = p.enablePuppet()
+		if err != nil {
+			return err
+		}
+		//Puppet is enabled now, so what follows is only tidying up
+		if err := p.unsilencePuppet(); err != nil {
+			tsLn("WARNING: Could not clear the silences:", err)
+		}
+		return forgetDisable()
 	}
 
 	//Deeeeefault
-	err = execPuppet()
-	return err
+	if !p.Facts {
+		err = waitForRun(p.Wait)
+		if err != nil {
+			return err
+		}
+	}
+	return p.runPuppet()
 }
 
-func enablePuppet() error {
-	err := execPuppet("--enable")
-	if err != nil {
+// runPuppet does a puppet run and says how it went. Like puppet's detailed
+// exit codes, the exitStatus returned tells no changes, changes and failures
+// apart. A run that fails for a reason that should soon go away, like the
+// puppetserver being restarted, is tried again up to p.Retries times.
+func (p *patCmd) runPuppet() error {
+	if p.Facts {
+		if err := p.execPuppet(); err != nil {
+			return puppetFailed("facts", err)
+		}
+		return nil
+	}
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		if p.Retries > 0 {
+			tsLn(fmt.Sprintf("ATTEMPT %d of %d at %s", attempt, p.Retries+1, start.Format(time.RFC3339)))
+		}
+		err := p.execPuppet("--detailed-exitcodes")
+		showLastRun(start)
+		if attempt > p.Retries {
+			return p.runResult(err)
+		}
+		reason := transientFailure(err, start, p.runner.Output())
+		if reason == "" {
+			return p.runResult(err)
+		}
+		tsLn("Transient failure:", reason)
+		tsLn("Trying again in", p.RetryDelay)
+		select {
+		case <-time.After(p.RetryDelay):
+		case sig := <-p.signals:
+			return p.runResult(&interruptedError{sig: sig})
+		}
+	}
+}
+
+// puppetFailed says that puppet couldn't do what it was asked, as an error
+// that makes pat exit with exitError rather than with puppet's own status.
+func puppetFailed(what string, err error) error {
+	return &exitStatus{code: exitError, err: fmt.Errorf("puppet %s failed: %v", what, err)}
+}
+
+// runResult turns the error from a puppet run into pat's verdict on it.
+func (p *patCmd) runResult(err error) error {
+	if err == errTimeout {
+		tsLn("RESULT: TIMED OUT")
+		return &exitStatus{code: exitTimeout, err: fmt.Errorf("puppet was stopped after running for longer than %s", p.Timeout)}
+	}
+	if e, ok := err.(*interruptedError); ok {
+		tsLn("RESULT: INTERRUPTED")
+		code := exitError
+		if sig, ok := e.sig.(syscall.Signal); ok {
+			//As a shell reports a process killed by sig
+			code = 128 + int(sig)
+		}
+		return &exitStatus{code: code, err: e}
+	}
+	exitErr, ok := err.(exitCoder)
+	if err != nil && !ok {
+		//Puppet didn't even run
 		return err
 	}
-	puppetDisabled = false
+	code := 0
+	if ok {
+		code = exitErr.ExitCode()
+	}
+	switch code {
+	case 0:
+		tsLn("RESULT: NO CHANGES")
+		return nil
+	case 2:
+		tsLn("RESULT: CHANGES APPLIED")
+		return &exitStatus{code: exitChanges}
+	case 4:
+		tsLn("RESULT: FAILURES")
+		return &exitStatus{code: exitFailures}
+	case 6:
+		tsLn("RESULT: CHANGES APPLIED, WITH FAILURES")
+		return &exitStatus{code: exitChangesAndFailures}
+	}
+	tsLn("RESULT: PUPPET RUN FAILED")
+	return &exitStatus{code: exitError, err: fmt.Errorf("puppet run failed: %v", err)}
+}
+
+func (p *patCmd) enablePuppet() error {
+	err := p.execPuppet("--enable")
+	if err != nil {
+		return puppetFailed("--enable", err)
+	}
+	p.disabled = false
+	return nil
+}
+
+// checkEnable refuses to enable puppet that someone else disabled less than
+// EnableGrace ago, unless Force is given with a Reason. Disables pat didn't
+// record can't be told apart, so are left to whoever finds them.
+func (p *patCmd) checkEnable(now time.Time) error {
+	if !p.disabled || p.EnableGrace <= 0 {
+		return nil
+	}
+	record, err := getDisableRecord()
+	if err != nil || !record.matches(p.message) {
+		return nil
+	}
+	user, _ := silence.RealUser()
+	if strings.EqualFold(record.disabledBy(), user) || now.Sub(record.DisabledAt) >= p.EnableGrace {
+		return nil
+	}
+	if !p.Force {
+		tsLn("WARNING: Puppet was disabled by", record.describe(now)+":", strings.Trim(p.message, "\""))
+		return fmt.Errorf("only %s may enable puppet for the first %s; use --force with a --reason to enable it anyway", record.disabledBy(), shortDuration(p.EnableGrace))
+	}
+	if p.Reason == "" {
+		return fmt.Errorf("--force needs a --reason, which is recorded in the history")
+	}
+	tsLn("WARNING: Enabling puppet, which was disabled by", record.describe(now)+", because:", p.Reason)
+	p.overrode = record.disabledBy()
 	return nil
 }
 
-// Disable puppet. If puppet is already disabled, will return an error
-func disablePuppet(message string) error {
-	if puppetDisabled {
+// Disable puppet. If puppet is already disabled, will return an error. The
+// disable is recorded in patDisableFile: record is kept if given, so that
+// pat once doesn't change who disabled puppet, otherwise a new one is made.
+func (p *patCmd) disablePuppet(message string, record *disableRecord) error {
+	if p.disabled {
 		return fmt.Errorf("Puppet is already disabled")
 	}
 	//If no message is specified, we have an interactive prompt to ask the user for the message
 	if message == "" {
-		puppetDisabledMessageDefault := defaultPuppetDisableMessage()
+		puppetDisabledMessageDefault := p.defaultDisableMessage()
 		//Ask the user for their disable message
 		reader := bufio.NewReader(os.Stdin)
 		tsLn("No disable message specified.")
@@ -184,28 +561,324 @@ func disablePuppet(message string) error {
 		}
 		tsLn()
 	}
+	if message == "" {
+		return fmt.Errorf("a disable message is needed")
+	}
 
 	//Clean a few things up - like removing linebreaks, and appending quotes around the message
 	message = strings.Replace(message, "\n", "", -1)
 
+	quotedMessage := message
 	if string(message[0]) != "\"" {
-		message = fmt.Sprintf("\"%s\"", message)
+		quotedMessage = fmt.Sprintf("\"%s\"", message)
 	}
 
-	err := execPuppet("--disable", message)
+	err := p.execPuppet("--disable", quotedMessage)
 	if err != nil {
-		return err
+		return puppetFailed("--disable", err)
+	}
+	p.disabled = true
+
+	message = strings.Trim(message, "\"")
+	p.message = message
+	if record == nil {
+		record = p.newDisableRecord(message)
+	}
+	if err := putDisableRecord(record); err != nil {
+		tsLn("WARNING: Could not record who disabled puppet:", err)
 	}
+	return p.silencePuppet(message)
+}
+
+// redisablePuppet disables puppet again after pat once. A ^C from the terminal
+// also reaches puppet, so signals are ignored meanwhile: otherwise a second ^C
+// could stop puppet --disable and leave puppet enabled.
+func (p *patCmd) redisablePuppet(message string, record *disableRecord) error {
+	signal.Ignore(os.Interrupt, syscall.SIGTERM)
+	defer signal.Reset(os.Interrupt, syscall.SIGTERM)
+	return p.disablePuppet(message, record)
+}
 
+// Silence the puppet.left.disabled alert for this host, unless we were asked not to
+func (p *patCmd) silencePuppet(message string) error {
+	if p.NoSilence {
+		tsLn("Not setting a silence")
+		return nil
+	}
+	message, err := p.expandMessage("silence", p.SilenceTemplate, defaultSilenceTemplate, message)
+	if err != nil {
+		return fmt.Errorf("puppet is disabled, but the silence message is bad: %v", err)
+	}
+	s, err := silence.NewSilenceRequest(silenceAlert, p.SilenceDuration, message, p.SilenceTags)
+	if err != nil {
+		return fmt.Errorf("puppet is disabled, but the silence duration is bad: %v", err)
+	}
+	// No silence is set with --noop, but show what it would have been
+	if p.Noop || p.SilenceDryRun {
+		summary, err := silence.DryRunSilence("", s)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(strings.TrimSpace(summary), "\n") {
+			tsLn(line)
+		}
+		return nil
+	}
+	summary, err := silence.SetSilence("", s)
+	if err != nil {
+		return fmt.Errorf("puppet is disabled, but setting the silence failed: %v", err)
+	}
+	tsLn(strings.TrimSpace(summary))
+	if s.ID == "" {
+		return nil
+	}
+	ids, err := getSilenceIDs()
+	if err == nil {
+		err = putSilenceIDs(append(ids, s.ID))
+	}
+	if err != nil {
+		tsLn("WARNING: Could not record the silence ID:", err)
+	}
 	return nil
 }
 
+// Clear the silences set when puppet was disabled. If we didn't record any,
+// clear whatever puppet.left.disabled silences this host has.
+func (p *patCmd) unsilencePuppet() error {
+	if p.NoSilence {
+		tsLn("Not clearing silences")
+		return nil
+	}
+	record, err := getDisableRecord()
+	if err != nil {
+		return err
+	}
+	ids := record.SilenceIDs
+	if len(ids) == 0 && record.NoSilence && record.matches(p.message) {
+		tsLn("No silence was set when puppet was disabled")
+		return nil
+	}
+	if p.Noop || p.SilenceDryRun {
+		if len(ids) == 0 {
+			tsLn("Dry run, not clearing silences of", silenceAlert, "on", p.SilenceTags)
+		} else {
+			tsLn("Dry run, not clearing silences:", strings.Join(ids, ", "))
+		}
+		return nil
+	}
+	summary, err := silence.EasyUnsilence(silenceAlert, ids, p.SilenceTags)
+	if err != nil {
+		return fmt.Errorf("puppet is enabled, but clearing the silence failed: %v", err)
+	}
+	tsLn(summary)
+	return putSilenceIDs(nil)
+}
+
+// newDisableRecord describes a disable being made now by whoever is running pat.
+func (p *patCmd) newDisableRecord(message string) *disableRecord {
+	r := &disableRecord{
+		Message:    message,
+		SudoUser:   silence.SudoUser(),
+		DisabledAt: time.Now().UTC().Truncate(time.Second),
+		Ticket:     p.Ticket,
+		NoSilence:  p.NoSilence,
+	}
+	r.User, _ = silence.LoginUser()
+	//We expect puppet back when the silence runs out, or pat reap enables it
+	if !p.NoSilence {
+		if end, err := silence.ParseEnd(p.SilenceDuration, time.Now()); err == nil {
+			end = end.UTC()
+			r.ExpectedEnable = &end
+		}
+	}
+	if p.DisableUntil != "" {
+		if end, err := silence.ParseDeadline(p.DisableUntil, time.Now()); err == nil {
+			end = end.UTC().Truncate(time.Second)
+			r.ReenableAt, r.ExpectedEnable = &end, &end
+		}
+	}
+	return r
+}
+
+// reaperRunning is whether pat reap has run in the last hour, as it does
+// every few minutes if cron or a timer runs it.
+func reaperRunning(now time.Time) bool {
+	contents, err := osReadStateFile(patReapFile)
+	if err != nil {
+		return false
+	}
+	last, err := time.Parse(time.RFC3339, strings.TrimSpace(string(contents)))
+	return err == nil && now.Sub(last) < time.Hour
+}
+
+// reapDue returns the record of a disable with --for or --until that has run
+// out, or nil if puppet isn't disabled like that.
+func reapDue(now time.Time) *disableRecord {
+	message, err := getPuppetDisabledMessage()
+	if err != nil || message == "" {
+		return nil
+	}
+	record, err := getDisableRecord()
+	if err != nil || !record.matches(message) || record.ReenableAt == nil || now.Before(*record.ReenableAt) {
+		return nil
+	}
+	return record
+}
+
+// reap enables puppet once a disable with --for or --until has run out, and
+// runs it. It's meant to be run every few minutes, by cron or a systemd
+// timer, so says nothing unless there is something to do.
+func (p *patCmd) reap(now time.Time) error {
+	if err := osWriteStateFile(patReapFile, []byte(now.UTC().Format(time.RFC3339)+"\n")); err != nil {
+		tsLn("WARNING: Could not record that pat reap ran:", err)
+	}
+	record := reapDue(now)
+	if record == nil {
+		if p.Debug {
+			tsLn("DEBUG: No disable has run out")
+		}
+		return nil
+	}
+	p.message, _ = getPuppetDisabledMessage()
+	p.reaped = true
+	tsLn("Puppet was disabled by", record.describe(now)+":", strings.Trim(p.message, "\""))
+	tsLn("Enabling puppet and running it")
+	if err := p.enablePuppet(); err != nil {
+		return err
+	}
+	//Puppet is enabled now, so the rest goes ahead regardless
+	if err := p.unsilencePuppet(); err != nil {
+		tsLn("WARNING: Could not clear the silences:", err)
+	}
+	if err := forgetDisable(); err != nil {
+		tsLn("WARNING: Could not forget who disabled puppet:", err)
+	}
+	if err := waitForRun(p.Wait); err != nil {
+		return err
+	}
+	return p.runPuppet()
+}
+
+// getDisableRecord reads patDisableFile. It returns an empty record if there isn't one.
+func getDisableRecord() (*disableRecord, error) {
+	r := &disableRecord{}
+	contents, err := osReadStateFile(patDisableFile)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contents, r); err != nil {
+		return nil, fmt.Errorf("%s: %v", patDisableFile, err)
+	}
+	//Older records have zero times for these instead of leaving them out
+	for _, t := range []**time.Time{&r.ExpectedEnable, &r.ReenableAt} {
+		if *t != nil && (*t).IsZero() {
+			*t = nil
+		}
+	}
+	return r, nil
+}
+
+// putDisableRecord writes r to patDisableFile, or removes the file if r is empty.
+func putDisableRecord(r *disableRecord) error {
+	if r == nil || (r.DisabledAt.IsZero() && len(r.SilenceIDs) == 0) {
+		return osRemoveStateFile(patDisableFile)
+	}
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return osWriteStateFile(patDisableFile, append(contents, '\n'))
+}
+
+// forgetDisable drops the disable record once puppet is enabled, keeping the
+// IDs of any silences that are still to be cleared.
+func forgetDisable() error {
+	ids, err := getSilenceIDs()
+	if err != nil {
+		return err
+	}
+	return putDisableRecord(&disableRecord{SilenceIDs: ids})
+}
+
+func getSilenceIDs() ([]string, error) {
+	r, err := getDisableRecord()
+	if err != nil {
+		return nil, err
+	}
+	return r.SilenceIDs, nil
+}
+
+func putSilenceIDs(ids []string) error {
+	r, err := getDisableRecord()
+	if err != nil {
+		return err
+	}
+	r.SilenceIDs = ids
+	return putDisableRecord(r)
+}
+
+// matches reports whether r was written for the disable with this message,
+// rather than left over from an earlier one or missing.
+func (r *disableRecord) matches(message string) bool {
+	return r != nil && !r.DisabledAt.IsZero() && r.Message == strings.Trim(message, "\"")
+}
+
+// disabledBy is who disabled puppet: the user behind sudo, if it was used.
+func (r *disableRecord) disabledBy() string {
+	if r.SudoUser != "" {
+		return r.SudoUser
+	}
+	return r.User
+}
+
+// describe says who disabled puppet and when, e.g.
+// "alice 3h12m ago, expected back at 14:00, ticket OPS-123".
+func (r *disableRecord) describe(now time.Time) string {
+	who := r.User
+	if who == "" {
+		who = "an unknown user"
+	}
+	if r.SudoUser != "" && r.SudoUser != r.User {
+		who = r.SudoUser + " as " + who
+	}
+	desc := fmt.Sprintf("%s %s ago", who, shortDuration(now.Sub(r.DisabledAt)))
+	if r.ExpectedEnable != nil {
+		back, label := r.ExpectedEnable.In(now.Location()), "expected back at "
+		if r.ReenableAt != nil {
+			back, label = r.ReenableAt.In(now.Location()), "to be enabled at "
+		}
+		layout := "15:04"
+		if back.Sub(now) > 20*time.Hour || now.Sub(back) > 20*time.Hour {
+			layout = "Mon Jan 2 15:04"
+		}
+		desc += ", " + label + back.Format(layout)
+		if back.Before(now) {
+			desc += " (overdue)"
+		}
+	}
+	if r.Ticket != "" {
+		desc += ", ticket " + r.Ticket
+	}
+	return desc
+}
+
+// shortDuration formats d to the minute, or to the second if it is shorter than that.
+func shortDuration(d time.Duration) string {
+	if d < time.Minute {
+		return d.Round(time.Second).String()
+	}
+	return strings.TrimSuffix(d.Round(time.Minute).String(), "0s")
+}
+
 // Executes puppet with the arguments provided, along with fixed arguments, and mixing in the additional
 // arguments that were specified on the command line
-func execPuppet(args ...string) error {
+func (p *patCmd) execPuppet(args ...string) error {
 	puppetArgs := []string{}
 	//If we're doing a fact run, we don't need the agent command
-	if isFacts {
+	if p.Facts {
 		puppetArgs = []string{"facts"}
 	}
 	// When we are disabling puppet, we need to drop the -t
@@ -219,69 +892,64 @@ func execPuppet(args ...string) error {
 	}
 
 	// These are the additional user-supplied arguments
-	for _, v := range additionalArguments {
+	for _, v := range p.PuppetArgs {
 		puppetArgs = append(puppetArgs, v)
 	}
 
 	// And we tack the parameter-supplied arguments onto the very end
 	puppetArgs = append(puppetArgs, args...)
 
-	if isDebug {
-		tsLn("DEBUG: Invoking", osPuppetBinPath, "with arguments:", puppetArgs)
-	}
-
-	//Execute and return
-	cmd, err := osMakeExec(osPuppetBinPath, puppetArgs...)
-	defer osCleanupExec(cmd)
-	if err != nil {
-		return err
-	}
-	cmdReaderStd, err := cmd.StdoutPipe()
-	if err != nil {
-		return err
-	}
-	scannerStd := bufio.NewScanner(cmdReaderStd)
-	go func() {
-		for scannerStd.Scan() {
-			tsPrintf("%s\n", scannerStd.Text())
-		}
-	}()
+	return p.runner.Run(p.signals, puppetArgs...)
+}
 
-	cmdReaderErr, err := cmd.StderrPipe()
+// Create a form message to use when disabling puppet if no message is specified
+func (p *patCmd) defaultDisableMessage() string {
+	message, err := p.expandMessage("disable", p.DisableTemplate, defaultDisableTemplate, "")
 	if err != nil {
-		return err
+		tsLn("WARNING: Bad disable message template:", err)
+		return ""
 	}
-	scannerErr := bufio.NewScanner(cmdReaderErr)
-	go func() {
-		for scannerErr.Scan() {
-			tsPrintf("%s\n", scannerErr.Text())
-		}
-	}()
+	return message
+}
 
-	err = cmd.Start()
-	if err != nil {
-		return err
-	}
-	err = cmd.Wait()
-	return err
+// messageData is what the message templates may use.
+type messageData struct {
+	Name     string // the user's full name
+	User     string // their login, behind sudo
+	Host     string
+	Duration string // how long the silence is for
+	Message  string // the disable message
+	Ticket   string
 }
 
-//Create a form message to use when disabling puppet if no message is specified
-func defaultPuppetDisableMessage() string {
-	currentUser, err := user.Current() //Get the current user for the form message
+// expandMessage fills in a message template, or the fallback if there isn't one.
+func (p *patCmd) expandMessage(name, text, fallback, message string) (string, error) {
+	if text == "" {
+		text = fallback
+	}
+	t, err := template.New(name).Parse(text)
 	if err != nil {
-		return ""
+		return "", err
+	}
+	data := messageData{Duration: p.SilenceDuration, Message: message, Ticket: p.Ticket}
+	if currentUser, err := user.Current(); err == nil {
+		data.Name = currentUser.Name
 	}
-	//Default form message
-	return fmt.Sprintf("Disabled by %s. If I forget to re-enable it after 2 hours, anyone may re-enable and any problems this causes are my responsibility.", currentUser.Name)
+	data.User, _ = silence.RealUser()
+	data.Host, _ = os.Hostname()
+	var b strings.Builder
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
 }
 
 func getPuppetDisabledMessage() (string, error) {
 	//Check if puppet is disabled so we can later on re-use the disabled message (or not run at all)
 	var puppetDisabledMessage string
 	//If we have a more specific puppet message, get it and use that instead of the form message
-	if _, err := os.Stat(osPuppetLockFile); err == nil {
-		lockMessageBytes, err := ioutil.ReadFile(osPuppetLockFile)
+	if _, err := os.Stat(puppetLockFile); err == nil {
+		lockMessageBytes, err := ioutil.ReadFile(puppetLockFile)
 		if err != nil {
 			return "", err
 		}
@@ -308,15 +976,22 @@ func ts() string {
 }
 
 func tsPrintf(format string, a ...interface{}) {
-	if isTimestamp {
-		fmt.Printf("%s", ts())
-	}
-	fmt.Printf(format, a...)
+	tsWrite(fmt.Sprintf(format, a...))
 }
 
 func tsLn(a ...interface{}) {
+	tsWrite(fmt.Sprintln(a...))
+}
+
+// tsWrite prints s, and copies it to the run log with a timestamp whether or
+// not --timestamp is set.
+func tsWrite(s string) {
+	stamp := ts()
 	if isTimestamp {
-		fmt.Printf("%s", ts())
+		fmt.Print(stamp)
+	}
+	fmt.Print(s)
+	if runLog != nil {
+		fmt.Fprint(runLog, stamp+s)
 	}
-	fmt.Println(a...)
 }
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	silence "github.com/StackExchange/pat/addsilence"
+)
+
+// fakeBosun is a stand-in for Bosun's silence API.
+type fakeBosun struct {
+	silences map[string]*silence.Silence
+	requests []silence.SilenceRequest
+	cleared  []string
+}
+
+func (f *fakeBosun) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/api/silence/set":
+		var s silence.SilenceRequest
+		json.NewDecoder(r.Body).Decode(&s)
+		f.requests = append(f.requests, s)
+		start, _ := time.Parse("2006-01-02 15:04:05 MST", s.Start)
+		end, _ := time.Parse("2006-01-02 15:04:05 MST", s.End)
+		delete(f.silences, s.Edit)
+		f.silences[fmt.Sprintf("id%d", len(f.requests))] = &silence.Silence{
+			Start: start, End: end, Alert: s.Alert, TagString: s.Tags, User: s.User, Message: s.Message,
+		}
+	case "/api/silence/get":
+		json.NewEncoder(w).Encode(f.silences)
+	case "/api/silence/clear":
+		delete(f.silences, r.FormValue("id"))
+		f.cleared = append(f.cleared, r.FormValue("id"))
+	}
+}
+
+// useStateDir points pat at a temporary state directory, returning it.
+func useStateDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "pat")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldStateDir, oldLogDir, oldSystemConfig, oldUserConfig := filepath.Dir(puppetLockFile), logDir, systemConfigFile, userConfigFile
+	oldBin, oldCache, oldUserCache, oldServer := puppetBinPath, puppetCacheFile, userPuppetCacheFile, puppetServer
+	setStateDir(dir)
+	logDir = filepath.Join(dir, "logs")
+	systemConfigFile = filepath.Join(dir, "config.yaml")
+	userConfigFile = filepath.Join(dir, "user-config.yaml")
+	//There's no puppet to ask where its state is
+	puppetBinPath = filepath.Join(dir, "no-puppet")
+	puppetCacheFile = filepath.Join(dir, "puppet.json")
+	userPuppetCacheFile = filepath.Join(dir, "user-cache", "puppet.json")
+	return dir, func() {
+		setStateDir(oldStateDir)
+		logDir, systemConfigFile, userConfigFile = oldLogDir, oldSystemConfig, oldUserConfig
+		puppetBinPath, puppetCacheFile, userPuppetCacheFile, puppetServer = oldBin, oldCache, oldUserCache, oldServer
+		os.RemoveAll(dir)
+	}
+}
+
+// startFakeBosun points pat at a fresh fakeBosun and a temporary state directory.
+func startFakeBosun(t *testing.T) (*fakeBosun, func()) {
+	f := &fakeBosun{silences: map[string]*silence.Silence{}}
+	ts := httptest.NewServer(f)
+	_, doneState := useStateDir(t)
+	oldHost, oldDefault := silence.DefaultHost, silence.Default
+	silence.DefaultHost = ts.URL
+	silence.Default = &silence.Bosun{}
+	return f, func() {
+		silence.DefaultHost, silence.Default = oldHost, oldDefault
+		ts.Close()
+		doneState()
+	}
+}
+
+func TestSilencePuppet(t *testing.T) {
+	tests := []struct {
+		noop      bool
+		nosilence bool
+		silenced  bool
+	}{
+		{false, false, true},
+		{true, false, false},
+		{false, true, false},
+		{true, true, false},
+	}
+	for i, test := range tests {
+		f, done := startFakeBosun(t)
+		p := newPatCmd(&options{Noop: test.noop, NoSilence: test.nosilence, SilenceDuration: "1h"}, &fakeRunner{})
+		if err := p.silencePuppet("maintenance"); err != nil {
+			t.Errorf("%v: %v", i, err)
+		}
+		done()
+		if silenced := len(f.requests) > 0; silenced != test.silenced {
+			t.Errorf("%v: expected silenced=%v got %v", i, test.silenced, silenced)
+			continue
+		}
+		if test.silenced && (f.requests[0].Alert != silenceAlert || f.requests[0].Message != "maintenance") {
+			t.Errorf("%v: unexpected silence %+v", i, f.requests[0])
+		}
+	}
+}
+
+func TestUnsilencePuppet(t *testing.T) {
+	f, done := startFakeBosun(t)
+	defer done()
+	p := newPatCmd(&options{SilenceDuration: "1h"}, &fakeRunner{})
+
+	// Two disables (e.g. --disable then --once) leave two silences behind.
+	for i := 0; i < 2; i++ {
+		if err := p.silencePuppet(fmt.Sprintf("maintenance %d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := getSilenceIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 recorded IDs, got %v", ids)
+	}
+
+	if err := p.unsilencePuppet(); err != nil {
+		t.Fatal(err)
+	}
+	if len(f.silences) != 0 {
+		t.Errorf("silences left behind: %v", f.silences)
+	}
+	if _, err := os.Stat(patDisableFile); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", patDisableFile, err)
+	}
+}
+
+func TestEnableWhenUnsilenceFails(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	ts := httptest.NewServer(nil)
+	ts.Close()
+	defer func(host string, s silence.Silencer) { silence.DefaultHost, silence.Default = host, s }(silence.DefaultHost, silence.Default)
+	silence.DefaultHost, silence.Default = ts.URL, &silence.Bosun{}
+
+	for i, nosilence := range []bool{true, false} {
+		disable := &options{Disable: true, DisableMessage: "upgrading", NoSilence: true}
+		if err := newPatCmd(disable, &fakeRunner{}).do(); err != nil {
+			t.Fatal(err)
+		}
+		if !nosilence {
+			//As if a silence had been set, that can't be cleared now
+			r, _ := getDisableRecord()
+			r.NoSilence = false
+			putDisableRecord(r)
+		}
+		//The silencer is only asked when there may be a silence to clear
+		p := newPatCmd(&options{}, &fakeRunner{})
+		p.message = "upgrading"
+		if err := p.unsilencePuppet(); (err == nil) != nosilence {
+			t.Errorf("%v: expected an error only when there was a silence to clear, got %v", i, err)
+		}
+		if err := newPatCmd(&options{Enable: true}, &fakeRunner{}).do(); err != nil {
+			t.Errorf("%v: expected puppet to be enabled anyway, got %v", i, err)
+		}
+		if r, _ := getDisableRecord(); !r.DisabledAt.IsZero() {
+			t.Errorf("%v: expected the disable to be forgotten, got %+v", i, r)
+		}
+	}
+}
+
+func TestBadSilenceDurationStopsEarly(t *testing.T) {
+	// If the duration weren't checked up front, this would try to run puppet.
+	_, done := useStateDir(t)
+	defer done()
+	for _, args := range [][]string{
+		{"-s", "3hr", "--disable", "--disable-message", "maintenance"},
+		{"-s", "until teatime", "--once"},
+		{"disable", "-s", "400d", "maintenance"},
+	} {
+		_, err := capturePat(args...)
+		if err == nil || !strings.Contains(err.Error(), "bad silence duration") {
+			t.Errorf("%v: expected a bad silence duration, got %v", args, err)
+		}
+	}
+	// A disable may be longer than a silence, but then can't be silenced for as long
+	if _, err := capturePat("disable", "--for", "30d", "maintenance"); err == nil || !strings.Contains(err.Error(), "--nosilence") {
+		t.Errorf("expected --for 30d to be too long a silence, got %v", err)
+	}
+}
+
+func TestDisableRecord(t *testing.T) {
+	_, done := startFakeBosun(t)
+	defer done()
+
+	r := &disableRecord{Message: "upgrading", User: "alice", DisabledAt: time.Now().UTC().Truncate(time.Second), Ticket: "OPS-1"}
+	if err := putDisableRecord(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := putSilenceIDs([]string{"id1"}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := getDisableRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.matches(`"upgrading"`) || got.matches("something else") || got.User != "alice" || got.Ticket != "OPS-1" || len(got.SilenceIDs) != 1 {
+		t.Errorf("unexpected record %+v", got)
+	}
+	// Times that weren't set are left out, even where older records had zeroes
+	if contents, _ := ioutil.ReadFile(patDisableFile); strings.Contains(string(contents), "expected_enable") {
+		t.Errorf("expected no expected_enable in:\n%s", contents)
+	}
+	old := []byte(`{"message": "upgrading", "expected_enable": "0001-01-01T00:00:00Z", "reenable_at": "0001-01-01T00:00:00Z"}`)
+	if err := ioutil.WriteFile(patDisableFile, old, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if old, err := getDisableRecord(); err != nil || old.ExpectedEnable != nil || old.ReenableAt != nil {
+		t.Errorf("expected zero times to be left out, got %+v (%v)", old, err)
+	}
+	if err := putDisableRecord(got); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enabling forgets the disable, but not the silences still to be cleared.
+	if err := forgetDisable(); err != nil {
+		t.Fatal(err)
+	}
+	got, err = getDisableRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.matches("upgrading") || len(got.SilenceIDs) != 1 {
+		t.Errorf("unexpected record after enable %+v", got)
+	}
+	if err := putSilenceIDs(nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(patDisableFile); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", patDisableFile, err)
+	}
+}
+
+func TestDisableRecordSudoUser(t *testing.T) {
+	defer func(f func() int) { silence.Geteuid = f }(silence.Geteuid)
+	defer os.Setenv("SUDO_USER", os.Getenv("SUDO_USER"))
+	os.Setenv("SUDO_USER", "alice")
+
+	p := newPatCmd(&options{NoSilence: true}, &fakeRunner{})
+	silence.Geteuid = func() int { return 0 }
+	if r := p.newDisableRecord("upgrading"); r.SudoUser != "alice" {
+		t.Errorf("expected sudo user (alice) got (%v)", r.SudoUser)
+	}
+	// Anyone but root could have set $SUDO_USER themselves
+	silence.Geteuid = func() int { return 1000 }
+	if r := p.newDisableRecord("upgrading"); r.SudoUser != "" {
+		t.Errorf("expected no sudo user got (%v)", r.SudoUser)
+	}
+}
+
+// timePtr is for a record's times that may be left out
+func timePtr(t time.Time) *time.Time {
+	return &t
+}
+
+func TestDescribeDisable(t *testing.T) {
+	now := time.Date(2024, 3, 5, 10, 48, 0, 0, time.UTC)
+	tests := []struct {
+		r        disableRecord
+		expected string
+	}{
+		{disableRecord{User: "alice", DisabledAt: now.Add(-192 * time.Minute), ExpectedEnable: timePtr(now.Add(72 * time.Minute))},
+			"alice 3h12m ago, expected back at 12:00"},
+		{disableRecord{User: "root", SudoUser: "bob", DisabledAt: now.Add(-30 * time.Second), Ticket: "OPS-1"},
+			"bob as root 30s ago, ticket OPS-1"},
+		{disableRecord{User: "alice", DisabledAt: now.Add(-2 * time.Hour), ExpectedEnable: timePtr(now.Add(-time.Hour))},
+			"alice 2h0m ago, expected back at 09:48 (overdue)"},
+		{disableRecord{DisabledAt: now.Add(-49 * time.Hour), ExpectedEnable: timePtr(now.Add(-48 * time.Hour))},
+			"an unknown user 49h0m ago, expected back at Sun Mar 3 10:48 (overdue)"},
+		{disableRecord{User: "alice", DisabledAt: now.Add(-time.Hour), ExpectedEnable: timePtr(now.Add(2 * time.Hour)), ReenableAt: timePtr(now.Add(2 * time.Hour))},
+			"alice 1h0m ago, to be enabled at 12:48"},
+	}
+	for i, test := range tests {
+		if got := test.r.describe(now); got != test.expected {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.expected, got)
+		}
+	}
+}
+
+// fakeRunner stands in for puppet. It enables and disables puppet as puppet
+// does, and otherwise fails with the next of its exit codes.
+type fakeRunner struct {
+	exits []int
+	runs  []string
+	// interrupt is a run that is stopped by ^C once it has done its work
+	interrupt string
+}
+
+func (f *fakeRunner) Run(signals <-chan os.Signal, args ...string) error {
+	run := strings.Join(args, " ")
+	f.runs = append(f.runs, run)
+	switch {
+	case len(args) > 1 && args[len(args)-2] == "--disable":
+		lock, _ := json.Marshal(disabledMessage{DisabledMessage: args[len(args)-1]})
+		return ioutil.WriteFile(puppetLockFile, lock, 0644)
+	case args[len(args)-1] == "--enable":
+		err := os.Remove(puppetLockFile)
+		if run == f.interrupt {
+			return &interruptedError{sig: os.Interrupt}
+		}
+		return err
+	}
+	if len(f.exits) == 0 {
+		return nil
+	}
+	code := f.exits[0]
+	f.exits = f.exits[1:]
+	if code != 0 {
+		return fakeExit(code)
+	}
+	return nil
+}
+
+func (f *fakeRunner) Output() []outputLine {
+	return nil
+}
+
+// fakeExit is how fakeRunner fails.
+type fakeExit int
+
+func (e fakeExit) Error() string {
+	return fmt.Sprintf("exit status %d", int(e))
+}
+
+func (e fakeExit) ExitCode() int {
+	return int(e)
+}
+
+func TestPatFlows(t *testing.T) {
+	reenable := []string{"agent -t --enable", "agent -t --detailed-exitcodes", `agent --disable "upgrading"`}
+	tests := []struct {
+		options options
+		// disabled is the message puppet is disabled with before and after, or "" if it is enabled
+		disabled string
+		exits    []int
+		runs     []string
+		code     int
+		after    string
+		// interrupt is a run stopped by ^C
+		interrupt string
+	}{
+		{options{Status: true, Format: "text"}, "", nil, nil, exitOK, "", ""},
+		{options{Status: true, Format: "json"}, "upgrading", nil, nil, exitDisabled, "upgrading", ""},
+		{options{}, "", []int{2}, []string{"agent -t --detailed-exitcodes"}, exitChanges, "", ""},
+		{options{PuppetArgs: []string{"--noop", "--tags", "nginx"}}, "", nil, []string{"agent -t --noop --tags nginx --detailed-exitcodes"}, exitOK, "", ""},
+		{options{Facts: true}, "", nil, []string{"facts"}, exitOK, "", ""},
+		{options{Once: true}, "", []int{6}, []string{"agent -t --detailed-exitcodes"}, exitChangesAndFailures, "", ""},
+		{options{Once: true}, "upgrading", []int{2}, reenable, exitChanges, "upgrading", ""},
+		// Puppet is disabled again even when the run fails
+		{options{Once: true}, "upgrading", []int{4}, reenable, exitFailures, "upgrading", ""},
+		{options{Once: true}, "upgrading", []int{1}, reenable, exitError, "upgrading", ""},
+		{options{Disable: true, DisableMessage: "rack move", Ticket: "OPS-2"}, "", nil, []string{`agent --disable "rack move"`}, exitOK, "rack move", ""},
+		{options{Disable: true, DisableMessage: "rack move"}, "upgrading", nil, nil, exitError, "upgrading", ""},
+		{options{Enable: true}, "upgrading", nil, []string{"agent -t --enable"}, exitOK, "", ""},
+		// ^C while puppet is being enabled for pat once
+		{options{Once: true}, "upgrading", nil, []string{"agent -t --enable", `agent --disable "upgrading"`}, exitError, "upgrading", "agent -t --enable"},
+	}
+	for i, test := range tests {
+		_, done := useStateDir(t)
+		if test.disabled != "" {
+			ioutil.WriteFile(puppetLockFile, []byte(fmt.Sprintf(`{"disabled_message":"\"%s\""}`, test.disabled)), 0644)
+			putDisableRecord(&disableRecord{Message: test.disabled, User: "alice", DisabledAt: time.Now().UTC().Truncate(time.Second)})
+		}
+		test.options.NoSilence = true
+		f := &fakeRunner{exits: test.exits, interrupt: test.interrupt}
+		err := newPatCmd(&test.options, f).do()
+
+		if code := exitCode(err); code != test.code {
+			t.Errorf("%v: expected exit code (%v) got (%v): %v", i, test.code, code, err)
+		}
+		if strings.Join(f.runs, "\n") != strings.Join(test.runs, "\n") {
+			t.Errorf("%v: expected puppet runs %q got %q", i, test.runs, f.runs)
+		}
+		message, err := getPuppetDisabledMessage()
+		if message = strings.Trim(message, `"`); err != nil || message != test.after {
+			t.Errorf("%v: expected puppet to be left disabled with (%v) got (%v) %v", i, test.after, message, err)
+		}
+		record, err := getDisableRecord()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case test.after == "" && !record.DisabledAt.IsZero():
+			t.Errorf("%v: disable record left behind: %+v", i, record)
+		case test.after != "" && !record.matches(message):
+			t.Errorf("%v: disable record lost: %+v", i, record)
+		case test.after == test.disabled && test.after != "" && record.User != "alice":
+			t.Errorf("%v: expected who disabled puppet to be kept, got %+v", i, record)
+		case test.options.Ticket != "" && record.Ticket != test.options.Ticket:
+			t.Errorf("%v: expected ticket (%v) got %+v", i, test.options.Ticket, record)
+		}
+		done()
+	}
+}
+
+func TestEnableGuard(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	defer func(f func() int) { silence.Geteuid = f }(silence.Geteuid)
+	defer os.Setenv("SUDO_USER", os.Getenv("SUDO_USER"))
+	os.Setenv("SUDO_USER", "alice")
+
+	tests := []struct {
+		// record is who disabled puppet, or nil if pat didn't
+		record *disableRecord
+		age    time.Duration
+		grace  time.Duration
+		force  bool
+		reason string
+		fails  bool
+		// overrode is who the history says was overridden
+		overrode string
+		// notRoot pretends pat isn't run as root
+		notRoot bool
+	}{
+		{&disableRecord{User: "bob"}, 10 * time.Minute, 2 * time.Hour, false, "", true, "", false},
+		{&disableRecord{User: "bob"}, 10 * time.Minute, 2 * time.Hour, true, "", true, "", false},
+		{&disableRecord{User: "bob"}, 10 * time.Minute, 2 * time.Hour, true, "nginx is down", false, "bob", false},
+		{&disableRecord{User: "root", SudoUser: "bob"}, 10 * time.Minute, 2 * time.Hour, true, "nginx is down", false, "bob", false},
+		{&disableRecord{User: "bob"}, 3 * time.Hour, 2 * time.Hour, false, "", false, "", false},
+		{&disableRecord{User: "bob"}, 10 * time.Minute, 0, false, "", false, "", false},
+		{&disableRecord{User: "alice"}, 10 * time.Minute, 2 * time.Hour, false, "", false, "", false},
+		{&disableRecord{User: "root", SudoUser: "Alice"}, 10 * time.Minute, 2 * time.Hour, false, "", false, "", false},
+		{nil, 10 * time.Minute, 2 * time.Hour, false, "", false, "", false},
+		// A $SUDO_USER set by anyone but root is not believed
+		{&disableRecord{User: "alice"}, 10 * time.Minute, 2 * time.Hour, false, "", true, "", true},
+	}
+	for i, test := range tests {
+		lock, _ := json.Marshal(disabledMessage{DisabledMessage: `"upgrading"`})
+		if err := ioutil.WriteFile(puppetLockFile, lock, 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Remove(patDisableFile)
+		if test.record != nil {
+			test.record.Message = "upgrading"
+			test.record.DisabledAt = time.Now().UTC().Add(-test.age)
+			if err := putDisableRecord(test.record); err != nil {
+				t.Fatal(err)
+			}
+		}
+		os.Remove(patHistoryFile)
+
+		silence.Geteuid = func() int {
+			if test.notRoot {
+				return 1000
+			}
+			return 0
+		}
+		f := &fakeRunner{}
+		err := newPatCmd(&options{Enable: true, NoSilence: true, EnableGrace: test.grace, Force: test.force, Reason: test.reason}, f).do()
+		if (err != nil) != test.fails {
+			t.Errorf("%v: expected failure (%v) got (%v)", i, test.fails, err)
+		}
+		if enabled := len(f.runs) > 0; enabled == test.fails {
+			t.Errorf("%v: expected puppet enabled (%v) got runs (%v)", i, !test.fails, f.runs)
+		}
+		history, err := getHistory()
+		if err != nil || len(history) != 1 {
+			t.Fatalf("%v: expected a history entry, got %v (%v)", i, history, err)
+		}
+		if history[0].Overrode != test.overrode || (test.overrode != "" && history[0].Reason != test.reason) {
+			t.Errorf("%v: expected override of (%v) got (%+v)", i, test.overrode, history[0])
+		}
+	}
+}
+
+func TestReap(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+
+	f := &fakeRunner{exits: []int{2}}
+	disable := &options{Disable: true, DisableMessage: "upgrading", DisableUntil: "1h", NoSilence: true}
+	if err := newPatCmd(disable, f).do(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := getDisableRecord()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	if r.ReenableAt == nil || r.ExpectedEnable == nil {
+		t.Fatalf("expected when puppet will be enabled to be recorded: %+v", r)
+	}
+	if d := r.ReenableAt.Sub(now); d < 59*time.Minute || d > time.Hour || !r.ExpectedEnable.Equal(*r.ReenableAt) {
+		t.Fatalf("expected puppet to be enabled again in 1h, got %+v", r)
+	}
+
+	if reaperRunning(now) {
+		t.Errorf("expected pat reap not to have run yet")
+	}
+	tests := []struct {
+		at   time.Time
+		runs []string
+	}{
+		// Not yet.
+		{now, nil},
+		{now.Add(2 * time.Hour), []string{"agent -t --enable", "agent -t --detailed-exitcodes"}},
+		// Puppet is enabled now.
+		{now.Add(3 * time.Hour), nil},
+	}
+	for i, test := range tests {
+		f.runs = nil
+		p := newPatCmd(&options{Reap: true, NoSilence: true}, f)
+		err := p.reap(test.at)
+		p.recordHistory(err)
+		if i == 1 && exitCode(err) != exitChanges {
+			t.Errorf("%v: expected the run's changes, got %v", i, err)
+		}
+		if strings.Join(f.runs, "; ") != strings.Join(test.runs, "; ") {
+			t.Errorf("%v: expected (%v) got (%v)", i, strings.Join(test.runs, "; "), strings.Join(f.runs, "; "))
+		}
+		if !reaperRunning(test.at) || reaperRunning(test.at.Add(2*time.Hour)) {
+			t.Errorf("%v: expected pat reap to be seen running for an hour", i)
+		}
+	}
+	if _, err := os.Stat(puppetLockFile); !os.IsNotExist(err) {
+		t.Errorf("expected puppet to be enabled, got %v", err)
+	}
+	if r, _ := getDisableRecord(); r.ReenableAt != nil {
+		t.Errorf("expected the disable to be forgotten, got %+v", r)
+	}
+	history, err := getHistory()
+	if err != nil || len(history) != 2 || history[1].Action != "reap" || history[1].Message != "upgrading" {
+		t.Errorf("expected the disable and one reap in the history, got %v (%v)", history, err)
+	}
+
+	//Disables without --for or --until are left alone
+	if err := newPatCmd(&options{Disable: true, DisableMessage: "upgrading", NoSilence: true}, f).do(); err != nil {
+		t.Fatal(err)
+	}
+	if reapDue(now.Add(48*time.Hour)) != nil {
+		t.Errorf("expected a disable without --for or --until not to be reaped")
+	}
+}
@@ -3,15 +3,26 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 const (
-	osRootName       = "root"
-	osRootMessage    = "If not run as root, it will run puppet via sudo automatically."
-	osPuppetLockFile = "/opt/puppetlabs/puppet/cache/state/agent_disabled.lock"
-	osPuppetBinPath  = "/opt/puppetlabs/bin/puppet"
+	osRootName        = "root"
+	osRootMessage     = "If not run as root, it will run puppet via sudo automatically."
+	osPuppetLockFile  = "/opt/puppetlabs/puppet/cache/state/agent_disabled.lock"
+	osPuppetBinPath   = "/opt/puppetlabs/bin/puppet"
+	osConfigFile      = "/etc/pat/config.yaml"
+	osLogDir          = "/var/log/pat"
+	osPuppetCacheFile = "/var/cache/pat/puppet.json"
 )
 
 func isRoot() bool {
@@ -35,3 +46,223 @@ func osMakeExec(osPuppetBinPath string, puppetArgs ...string) (*exec.Cmd, error)
 func osCleanupExec(cmd *exec.Cmd) {
 	return
 }
+
+// Puppet's state directory is only writable by root, so if we aren't root
+// we fall back to sudo, just as we do for puppet itself.
+func osReadStateFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err == nil || isRoot() || !os.IsPermission(err) {
+		return data, err
+	}
+	data, err = exec.Command("sudo", "cat", path).Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		// The likeliest reason for cat to fail is that there's no such file
+		return nil, &os.PathError{Op: "open", Path: path, Err: os.ErrNotExist}
+	}
+	return data, err
+}
+
+func osWriteStateFile(path string, data []byte) error {
+	err := ioutil.WriteFile(path, data, 0644)
+	if err == nil || isRoot() || !os.IsPermission(err) {
+		return err
+	}
+	cmd := exec.Command("sudo", "tee", path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func osAppendStateFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return err
+	}
+	if isRoot() || !os.IsPermission(err) {
+		return err
+	}
+	cmd := exec.Command("sudo", "tee", "-a", path)
+	cmd.Stdin = bytes.NewReader(data)
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// Run logs are kept where only root can write them, so like puppet's state
+// they are written through sudo if we aren't root: sudo makes the directory
+// and the file, then tee appends to it what pat writes.
+func osCreateLogFile(path string) (io.WriteCloser, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0750)
+	if err == nil {
+		var f *os.File
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+		if err == nil {
+			return f, nil
+		}
+	}
+	if isRoot() || !os.IsPermission(err) {
+		return nil, err
+	}
+	for _, args := range [][]string{{"install", "-d", "-m", "0750", filepath.Dir(path)}, {"install", "-m", "0640", "/dev/null", path}} {
+		cmd := exec.Command("sudo", args...)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return nil, fmt.Errorf("sudo %s: %v", strings.Join(args, " "), err)
+		}
+	}
+	cmd := exec.Command("sudo", "tee", "-a", path)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &sudoWriter{stdin, cmd}, nil
+}
+
+// sudoWriter writes to a file through sudo tee.
+type sudoWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// Close waits for tee to finish writing
+func (w *sudoWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if werr := w.cmd.Wait(); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// The names of the files in a state directory, which sudo lists if we can't
+func osListStateDir(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err == nil {
+		var names []string
+		for _, f := range files {
+			if !f.IsDir() {
+				names = append(names, f.Name())
+			}
+		}
+		return names, nil
+	}
+	if isRoot() || !os.IsPermission(err) {
+		return nil, err
+	}
+	out, err := exec.Command("sudo", "ls", "-1", dir).Output()
+	if _, ok := err.(*exec.ExitError); ok {
+		return nil, &os.PathError{Op: "open", Path: dir, Err: os.ErrNotExist}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// A config file may only be changed by root and its owner, who must be root
+// or whoever is running pat
+func osTrustConfig(fi os.FileInfo) bool {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return false
+	}
+	owner := int(st.Uid)
+	return (owner == 0 || owner == os.Geteuid()) && fi.Mode().Perm()&0022 == 0
+}
+
+func osRemoveStateFile(path string) error {
+	err := os.Remove(path)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	if isRoot() || !os.IsPermission(err) {
+		return err
+	}
+	return exec.Command("sudo", "rm", "-f", path).Run()
+}
+
+// Signal 0 checks that the process exists, without touching it
+func osProcessRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Puppet gets its own process group, so that it can be stopped along with
+// everything it runs. Not through sudo, though, which may need the terminal
+// to ask for a password; see osSignalPuppet for how that is stopped.
+func osNewProcessGroup(cmd *exec.Cmd) {
+	if isRoot() {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	}
+}
+
+// Ask puppet to stop with SIGTERM, or make it with SIGKILL
+func osStopPuppet(cmd *exec.Cmd, kill bool) error {
+	if kill {
+		return osSignalPuppet(cmd, syscall.SIGKILL)
+	}
+	return osSignalPuppet(cmd, syscall.SIGTERM)
+}
+
+// Signal puppet's process group if it has one. Otherwise, if pat isn't root,
+// puppet runs under sudo, which can't pass SIGKILL on, and only passes other
+// signals to puppet: so puppet and everything it started are signalled with
+// sudo kill, as is sudo itself when killing.
+func osSignalPuppet(cmd *exec.Cmd, sig os.Signal) error {
+	s, ok := sig.(syscall.Signal)
+	if ok && cmd.SysProcAttr != nil && cmd.SysProcAttr.Setpgid {
+		return syscall.Kill(-cmd.Process.Pid, s)
+	}
+	if !ok || isRoot() {
+		return cmd.Process.Signal(sig)
+	}
+	pids := descendants(cmd.Process.Pid)
+	if s == syscall.SIGKILL {
+		pids = append(pids, cmd.Process.Pid)
+	}
+	if len(pids) == 0 {
+		return cmd.Process.Signal(sig)
+	}
+	//-n, as sudo mustn't stop to ask for a password while puppet is left running
+	args := []string{"-n", "kill", "-" + strconv.Itoa(int(s))}
+	for _, pid := range pids {
+		args = append(args, strconv.Itoa(pid))
+	}
+	if err := exec.Command("sudo", args...).Run(); err != nil {
+		return cmd.Process.Signal(sig)
+	}
+	return nil
+}
+
+// descendants lists the processes pid started, the processes they started,
+// and so on
+func descendants(pid int) []int {
+	out, err := exec.Command("ps", "-A", "-o", "pid=,ppid=").Output()
+	if err != nil {
+		return nil
+	}
+	children := map[int][]int{}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		child, err := strconv.Atoi(fields[0])
+		parent, perr := strconv.Atoi(fields[1])
+		if err == nil && perr == nil {
+			children[parent] = append(children[parent], child)
+		}
+	}
+	var pids []int
+	for queue := append([]int(nil), children[pid]...); len(queue) > 0; queue = queue[1:] {
+		pids = append(pids, queue[0])
+		queue = append(queue, children[queue[0]]...)
+	}
+	return pids
+}
@@ -7,18 +7,23 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 const (
-	osRootName       = "administrator"
-	osRootMessage    = "If not run as administrator, the run will fail immediately."
-	osPuppetLockFile = "C:/ProgramData/PuppetLabs/puppet/cache/state/agent_disabled.lock"
-	osPuppetBinPath  = "C:/Program Files/Puppet Labs/Puppet/bin/puppet.bat"
+	osRootName        = "administrator"
+	osRootMessage     = "If not run as administrator, the run will fail immediately."
+	osPuppetLockFile  = "C:/ProgramData/PuppetLabs/puppet/cache/state/agent_disabled.lock"
+	osPuppetBinPath   = "C:/Program Files/Puppet Labs/Puppet/bin/puppet.bat"
+	osConfigFile      = "C:/ProgramData/pat/config.yaml"
+	osLogDir          = "C:/ProgramData/pat/logs"
+	osPuppetCacheFile = "C:/ProgramData/pat/cache/puppet.json"
 )
 
 func isRoot() bool {
@@ -40,9 +45,6 @@ func osMakeExec(osPuppetBinPath string, puppetArgs ...string) (*exec.Cmd, error)
 	if err != nil {
 		return nil, err
 	}
-	if isDebug {
-		tsLn("DEBUG: Batch file contents:", batchContents)
-	}
 
 	cmd := exec.Command(runBatch)
 	return cmd, nil
@@ -50,12 +52,93 @@ func osMakeExec(osPuppetBinPath string, puppetArgs ...string) (*exec.Cmd, error)
 
 // We don't want to leave hundreds of batch files lying around, so clean them up
 func osCleanupExec(cmd *exec.Cmd) {
-	if isDebug {
-		tsLn("DEBUG: Removing", cmd.Path)
-	}
 	os.Remove(cmd.Path)
 }
 
+// We always run as administrator, so the state directory can be used directly
+func osReadStateFile(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+func osWriteStateFile(path string, data []byte) error {
+	return ioutil.WriteFile(path, data, 0644)
+}
+
+func osAppendStateFile(path string, data []byte) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func osCreateLogFile(path string) (io.WriteCloser, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0640)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func osListStateDir(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if !f.IsDir() {
+			names = append(names, f.Name())
+		}
+	}
+	return names, nil
+}
+
+// Windows file permissions are ACLs, which are left to the administrator
+func osTrustConfig(fi os.FileInfo) bool {
+	return true
+}
+
+func osRemoveStateFile(path string) error {
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// taskkill /T stops the whole tree of processes, so there's no need for a group
+func osNewProcessGroup(cmd *exec.Cmd) {
+}
+
+// Windows can't ask a console program to stop, so puppet is always killed
+func osStopPuppet(cmd *exec.Cmd, kill bool) error {
+	return exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(cmd.Process.Pid)).Run()
+}
+
+// Every process on the console gets Ctrl-C already, and there's no sending
+// it to just one
+func osSignalPuppet(cmd *exec.Cmd, sig os.Signal) error {
+	return nil
+}
+
+// FindProcess opens the process, so it fails if there isn't one
+func osProcessRunning(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
 // https://stackoverflow.com/questions/28005865/golang-generate-unique-filename-with-extension
 func tempFileName(prefix, suffix string) string {
 	randBytes := make([]byte, 16)
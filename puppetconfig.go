@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// puppetCacheFile keeps what puppet said about where its state is, as asking
+// takes a second or two. Tests change it.
+var puppetCacheFile = osPuppetCacheFile
+
+// userPuppetCacheFile is kept instead by users who can't write
+// puppetCacheFile, so that they don't ask (through sudo) every time. Root
+// has none, as it mustn't be pointed at state a user chose. Tests change it.
+var userPuppetCacheFile = osUserPuppetCacheFile()
+
+// puppetServer is the puppetserver puppet said it uses, if it was asked.
+var puppetServer string
+
+// puppetCacheAge is how long what puppet said is trusted, even if neither
+// puppet nor its config has changed.
+const puppetCacheAge = 24 * time.Hour
+
+// The puppet settings pat asks for.
+var puppetSettingNames = []string{
+	"agent_disabled_lockfile",
+	"statedir",
+	"lastrunfile",
+	"lastrunreport",
+	"agent_catalog_run_lockfile",
+	"server",
+	"config",
+}
+
+// puppetCache is what puppet said, and what about puppet it was true for.
+type puppetCache struct {
+	Bin            string            `json:"bin"`
+	BinModified    time.Time         `json:"bin_modified"`
+	ConfigModified time.Time         `json:"config_modified"`
+	Fetched        time.Time         `json:"fetched"`
+	Settings       map[string]string `json:"settings"`
+}
+
+// findPuppet returns the puppet command to run. If puppet isn't where its
+// all-in-one package puts it, it may be a distro's or openvox's on the PATH.
+func findPuppet(bin string) string {
+	if bin != osPuppetBinPath {
+		return bin
+	}
+	if _, err := os.Stat(bin); err == nil {
+		return bin
+	}
+	if path, err := exec.LookPath("puppet"); err == nil {
+		return path
+	}
+	return bin
+}
+
+// getPuppetSettings asks puppet where it keeps its state, unless it has
+// been asked since it or its config last changed.
+func getPuppetSettings() (map[string]string, error) {
+	for _, path := range []string{puppetCacheFile, userPuppetCacheFile} {
+		if cache, err := readPuppetCache(path); err == nil && cache.fresh() {
+			return cache.Settings, nil
+		}
+	}
+	cmd, err := makeExec(puppetBinPath, append([]string{"config", "print", "--section", "agent"}, puppetSettingNames...)...)
+	defer osCleanupExec(cmd)
+	if err != nil {
+		return nil, err
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("puppet config print: %v", err)
+	}
+	settings, err := parsePuppetSettings(string(out))
+	if err != nil {
+		return nil, err
+	}
+	cache := &puppetCache{Bin: puppetBinPath, Fetched: time.Now().UTC(), Settings: settings}
+	cache.BinModified, cache.ConfigModified = modified(puppetBinPath), modified(settings["config"])
+	//Not being able to cache only makes pat slower
+	if err := writePuppetCache(puppetCacheFile, cache); err != nil && userPuppetCacheFile != "" {
+		writePuppetCache(userPuppetCacheFile, cache)
+	}
+	return settings, nil
+}
+
+// parsePuppetSettings reads the "name = value" lines of puppet config print.
+func parsePuppetSettings(out string) (map[string]string, error) {
+	settings := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		kv := strings.SplitN(line, " = ", 2)
+		if len(kv) == 2 {
+			settings[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+		}
+	}
+	for _, name := range []string{"agent_disabled_lockfile", "statedir"} {
+		if settings[name] == "" {
+			return nil, fmt.Errorf("puppet config print didn't say what %s is", name)
+		}
+	}
+	return settings, nil
+}
+
+// setPuppetPaths points pat at the state puppet said it keeps.
+func setPuppetPaths(settings map[string]string) {
+	setStateDir(settings["statedir"])
+	puppetLockFile = settings["agent_disabled_lockfile"]
+	puppetServer = settings["server"]
+	for path, name := range map[*string]string{
+		&puppetLastRunFile: "lastrunfile",
+		&puppetReportFile:  "lastrunreport",
+		&puppetRunLockFile: "agent_catalog_run_lockfile",
+	} {
+		if settings[name] != "" {
+			*path = settings[name]
+		}
+	}
+}
+
+// fresh is whether the cache is still true of puppet.
+func (c *puppetCache) fresh() bool {
+	return c.Bin == puppetBinPath &&
+		time.Since(c.Fetched) < puppetCacheAge &&
+		c.BinModified.Equal(modified(c.Bin)) &&
+		c.ConfigModified.Equal(modified(c.Settings["config"]))
+}
+
+func readPuppetCache(path string) (*puppetCache, error) {
+	if path == "" {
+		return nil, os.ErrNotExist
+	}
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cache := &puppetCache{}
+	if err := json.Unmarshal(contents, cache); err != nil {
+		return nil, err
+	}
+	return cache, nil
+}
+
+func writePuppetCache(path string, cache *puppetCache) error {
+	contents, err := json.MarshalIndent(cache, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, contents, 0644)
+}
+
+// osUserPuppetCacheFile is the user's puppet cache, under their cache
+// directory, or "" for root.
+func osUserPuppetCacheFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil || isRoot() {
+		return ""
+	}
+	return filepath.Join(dir, "pat", "puppet.json")
+}
+
+// modified is when path last changed, or the zero time if it can't be told.
+func modified(path string) time.Time {
+	if path == "" {
+		return time.Time{}
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return fi.ModTime().UTC()
+}
@@ -0,0 +1,139 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePuppetSettings(t *testing.T) {
+	tests := []struct {
+		out      string
+		lockfile string
+		server   string
+		ok       bool
+	}{
+		{"agent_disabled_lockfile = /var/lib/puppet/state/agent_disabled.lock\nstatedir = /var/lib/puppet/state\nserver = puppet\n", "/var/lib/puppet/state/agent_disabled.lock", "puppet", true},
+		{"statedir = /var/lib/puppet/state\r\nagent_disabled_lockfile = C:/state/agent_disabled.lock\r\n", "C:/state/agent_disabled.lock", "", true},
+		{"Warning: something\nstatedir = /var/lib/puppet/state\n", "", "", false},
+		{"", "", "", false},
+	}
+	for i, test := range tests {
+		settings, err := parsePuppetSettings(test.out)
+		if (err == nil) != test.ok {
+			t.Errorf("%v: expected ok (%v) got %v", i, test.ok, err)
+			continue
+		}
+		if settings["agent_disabled_lockfile"] != test.lockfile || settings["server"] != test.server {
+			t.Errorf("%v: expected (%v, %v) got %v", i, test.lockfile, test.server, settings)
+		}
+	}
+}
+
+func TestPuppetDiscovery(t *testing.T) {
+	dir, done := useStateDir(t)
+	defer done()
+	defer func(e func(string, ...string) (*exec.Cmd, error)) { makeExec = e }(makeExec)
+	makeExec = func(path string, args ...string) (*exec.Cmd, error) {
+		return exec.Command(path, args...), nil
+	}
+	state := filepath.Join(dir, "elsewhere")
+	conf := filepath.Join(dir, "puppet.conf")
+	if err := ioutil.WriteFile(conf, []byte("[agent]\nstatedir = "+state+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	bin := filepath.Join(dir, "puppet")
+	script := fmt.Sprintf(`#!/bin/sh
+echo "$*" >> %[1]s/asked
+echo "agent_disabled_lockfile = %[2]s/disabled.lock"
+echo "statedir = %[2]s"
+echo "lastrunfile = %[2]s/summary.yaml"
+echo "server = puppet.example.com"
+echo "config = %[3]s"
+`, dir, state, conf)
+	if err := ioutil.WriteFile(bin, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	puppetBinPath = bin
+	asked := func() int {
+		contents, _ := ioutil.ReadFile(filepath.Join(dir, "asked"))
+		return strings.Count(string(contents), "config print --section agent")
+	}
+
+	tests := []struct {
+		args     []string
+		touch    string
+		asked    int
+		lockfile string
+	}{
+		{nil, "", 1, filepath.Join(state, "disabled.lock")},
+		// Puppet isn't asked again until it or its config changes
+		{nil, "", 1, filepath.Join(state, "disabled.lock")},
+		{nil, conf, 2, filepath.Join(state, "disabled.lock")},
+		{nil, bin, 3, filepath.Join(state, "disabled.lock")},
+		// Unless the state dir is set
+		{[]string{"--state-dir", dir}, "", 3, filepath.Join(dir, "agent_disabled.lock")},
+	}
+	for i, test := range tests {
+		if test.touch != "" {
+			later := time.Now().Add(time.Duration(i) * time.Minute)
+			os.Chtimes(test.touch, later, later)
+		}
+		setStateDir(dir)
+		out, err := capturePat(append(test.args, "--status")...)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if n := asked(); n != test.asked {
+			t.Errorf("%v: expected puppet to be asked (%v) times, got (%v)", i, test.asked, n)
+		}
+		if puppetLockFile != test.lockfile {
+			t.Errorf("%v: expected lock file (%v) got (%v)", i, test.lockfile, puppetLockFile)
+		}
+		if test.args == nil && !strings.Contains(out, "PUPPET SERVER:  puppet.example.com") {
+			t.Errorf("%v: expected the puppet server in:\n%s", i, out)
+		}
+		if puppetLastRunFile != filepath.Join(state, "summary.yaml") && test.args == nil {
+			t.Errorf("%v: expected lastrunfile from puppet, got (%v)", i, puppetLastRunFile)
+		}
+	}
+
+	// Nor is it asked by commands that don't need it
+	if _, err := capturePat("logs"); err != nil || asked() != 3 {
+		t.Errorf("expected pat logs not to ask puppet, got (%v) asks: %v", asked(), err)
+	}
+
+	// Users who can't write the cache keep their own
+	puppetCacheFile = filepath.Join(bin, "puppet.json")
+	later := time.Now().Add(30 * time.Minute)
+	os.Chtimes(conf, later, later)
+	for i := 0; i < 2; i++ {
+		if _, err := capturePat("--status"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(userPuppetCacheFile); err != nil || asked() != 4 {
+		t.Errorf("expected puppet to be asked once more and cached in %s, got (%v) asks: %v", userPuppetCacheFile, asked(), err)
+	}
+
+	// If puppet can't be asked, pat makes do
+	if err := ioutil.WriteFile(bin, []byte("#!/bin/sh\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	later = time.Now().Add(time.Hour)
+	os.Chtimes(bin, later, later)
+	setStateDir(dir)
+	if _, err := capturePat("--status"); err != nil {
+		t.Fatal(err)
+	}
+	if puppetLockFile != filepath.Join(dir, "agent_disabled.lock") {
+		t.Errorf("expected the lock file to be left alone, got (%v)", puppetLockFile)
+	}
+}
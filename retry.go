@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// transientErrors are what puppet says when a run fails for a reason that
+// should go away by itself, such as the puppetserver being restarted.
+var transientErrors = []string{
+	"Error 503 on SERVER",
+	"503 Service Unavailable",
+	"execution expired",
+	"Net::ReadTimeout",
+	"Net::OpenTimeout",
+	"Connection reset by peer",
+	"Connection refused - connect(2)",
+	"SSL_connect",
+	"Failed to open TCP connection",
+	"Temporary failure in name resolution",
+	"Run of Puppet configuration client already in progress",
+}
+
+// transientFailure returns why the run that started at start failed, if it
+// failed for a reason that is worth trying again, judging by puppet's report
+// and its output. It returns "" if the run worked, or failed in a way that
+// another run won't fix, like resources failing to apply.
+func transientFailure(err error, start time.Time, output []outputLine) string {
+	exitErr, ok := err.(exitCoder)
+	//Only retry runs that didn't get as far as applying a catalog
+	if !ok || exitErr.ExitCode() != 1 {
+		return ""
+	}
+	var messages []string
+	report, rerr := getLastRunReport(start)
+	if rerr != nil {
+		tsLn("WARNING: Could not read the run report:", rerr)
+	}
+	if report != nil {
+		for _, r := range report.ResourceStatuses {
+			if r.Failed {
+				return ""
+			}
+		}
+		for _, l := range report.Logs {
+			if l.Level == "err" || l.Level == "warning" {
+				messages = append(messages, l.Message)
+			}
+		}
+	}
+	for _, l := range output {
+		messages = append(messages, l.Text)
+	}
+	for _, m := range messages {
+		for _, e := range transientErrors {
+			if strings.Contains(m, e) {
+				return strings.TrimSpace(m)
+			}
+		}
+	}
+	return ""
+}
+
+// getLastRunReport reads puppet's report of the run that started at start,
+// or returns nil if puppet didn't write one.
+func getLastRunReport(start time.Time) (*lastRunReport, error) {
+	if fi, err := os.Stat(puppetReportFile); err == nil && fi.ModTime().Before(start.Truncate(time.Second)) {
+		return nil, nil
+	}
+	contents, err := osReadStateFile(puppetReportFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r lastRunReport
+	if err := yaml.Unmarshal(contents, &r); err != nil {
+		return nil, fmt.Errorf("%s: %v", puppetReportFile, err)
+	}
+	return &r, nil
+}
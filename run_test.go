@@ -0,0 +1,398 @@
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakePuppetScript logs its arguments, and enables and disables like puppet
+// does. It can't say where its state is, so pat keeps the test's. Otherwise it prints $FAKE_PUPPET_OUTPUT, copies $FAKE_PUPPET_REPORT
+// to last_run_report.yaml, and waits for a child of its to sleep for
+// $FAKE_PUPPET_SLEEP and leave a file called survived. Then it exits with
+// $FAKE_PUPPET_EXIT, or the Nth code in it on the Nth run.
+const fakePuppetScript = `#!/bin/sh
+case "$*" in
+"config print"*)
+	exit 1 ;;
+esac
+echo "$*" >> %[1]s/puppet.log
+case "$*" in
+*--enable*)
+	rm -f %[2]s
+	exit 0 ;;
+*--disable*)
+	for msg; do :; done
+	printf '{"disabled_message":"%%s"}' "$(echo "$msg" | sed 's/"/\\"/g')" > %[2]s
+	exit 0 ;;
+esac
+echo "$FAKE_PUPPET_OUTPUT"
+[ -n "$FAKE_PUPPET_REPORT" ] && cp "$FAKE_PUPPET_REPORT" %[1]s/last_run_report.yaml
+(sleep ${FAKE_PUPPET_SLEEP:-0}; touch %[1]s/survived) >/dev/null 2>&1 &
+wait
+run=$(grep -c detailed-exitcodes %[1]s/puppet.log)
+exit $(echo ${FAKE_PUPPET_EXIT:-0} | awk -v n=$run '{ print n <= NF ? $n : $NF }')
+`
+
+// useFakePuppet points pat at a fake puppet, and a temporary state directory.
+// The returned func reads the arguments puppet was run with, one run per line.
+func useFakePuppet(t *testing.T) (func() []string, func()) {
+	dir, doneState := useStateDir(t)
+	bin := filepath.Join(dir, "puppet")
+	if err := ioutil.WriteFile(bin, []byte(fmt.Sprintf(fakePuppetScript, dir, puppetLockFile)), 0755); err != nil {
+		t.Fatal(err)
+	}
+	oldBin, oldExec := puppetBinPath, makeExec
+	puppetBinPath = bin
+	makeExec = func(path string, args ...string) (*exec.Cmd, error) {
+		return exec.Command(path, args...), nil
+	}
+	runs := func() []string {
+		log, _ := ioutil.ReadFile(filepath.Join(dir, "puppet.log"))
+		return strings.Split(strings.TrimSpace(string(log)), "\n")
+	}
+	return runs, func() {
+		puppetBinPath, makeExec = oldBin, oldExec
+		os.Unsetenv("FAKE_PUPPET_EXIT")
+		os.Unsetenv("FAKE_PUPPET_SLEEP")
+		os.Unsetenv("FAKE_PUPPET_OUTPUT")
+		os.Unsetenv("FAKE_PUPPET_REPORT")
+		doneState()
+	}
+}
+
+func TestDetailedExitCodes(t *testing.T) {
+	tests := []struct {
+		puppetExit string
+		code       int
+		result     string
+	}{
+		{"0", exitOK, "NO CHANGES"},
+		{"2", exitChanges, "CHANGES APPLIED"},
+		{"4", exitFailures, "FAILURES"},
+		{"6", exitChangesAndFailures, "CHANGES APPLIED, WITH FAILURES"},
+		{"1", exitError, "PUPPET RUN FAILED"},
+	}
+	for i, test := range tests {
+		runs, done := useFakePuppet(t)
+		os.Setenv("FAKE_PUPPET_EXIT", test.puppetExit)
+		out, err := capturePat()
+		if code := exitCode(err); code != test.code {
+			t.Errorf("%v: expected exit code (%v) got (%v): %v", i, test.code, code, err)
+		}
+		if !strings.Contains(out, "RESULT: "+test.result+"\n") {
+			t.Errorf("%v: expected result %q in:\n%s", i, test.result, out)
+		}
+		if r := runs(); len(r) != 1 || r[0] != "agent -t --detailed-exitcodes" {
+			t.Errorf("%v: unexpected puppet runs %q", i, r)
+		}
+		done()
+	}
+}
+
+func TestOnceRedisablesAfterFailure(t *testing.T) {
+	runs, done := useFakePuppet(t)
+	defer done()
+	if err := ioutil.WriteFile(puppetLockFile, []byte(`{"disabled_message":"\"upgrading\""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FAKE_PUPPET_EXIT", "4")
+
+	_, err := capturePat("--nosilence", "--once")
+	if code := exitCode(err); code != exitFailures {
+		t.Errorf("expected exit code (%v) got (%v): %v", exitFailures, code, err)
+	}
+	expected := []string{"agent -t --enable", "agent -t --detailed-exitcodes", `agent --disable "upgrading"`}
+	if r := runs(); strings.Join(r, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected puppet runs %q got %q", expected, r)
+	}
+	message, err := getPuppetDisabledMessage()
+	if err != nil || message != `"upgrading"` {
+		t.Errorf("expected puppet to be disabled again with its message, got %q %v", message, err)
+	}
+}
+
+func TestWaitForRun(t *testing.T) {
+	defer func(poll time.Duration) { runLockPoll = poll }(runLockPoll)
+	runLockPoll = 10 * time.Millisecond
+	tests := []struct {
+		pid      int
+		args     []string
+		finishes bool
+		code     int
+		ran      bool
+	}{
+		{os.Getpid(), nil, false, exitRunInProgress, false},
+		{os.Getpid(), []string{"--wait", "50ms"}, false, exitRunInProgress, false},
+		{os.Getpid(), []string{"--wait", "5s"}, true, exitOK, true},
+		{os.Getpid(), []string{"--once"}, false, exitRunInProgress, false},
+		// Puppet died without removing its lock
+		{-1, nil, false, exitOK, true},
+	}
+	for i, test := range tests {
+		runs, done := useFakePuppet(t)
+		pid := test.pid
+		if pid < 0 {
+			cmd := exec.Command("true")
+			cmd.Run()
+			pid = cmd.Process.Pid
+		}
+		ioutil.WriteFile(puppetRunLockFile, []byte(fmt.Sprintln(pid)), 0644)
+		if test.finishes {
+			lock := puppetRunLockFile
+			time.AfterFunc(50*time.Millisecond, func() { os.Remove(lock) })
+		}
+
+		out, err := capturePat(test.args...)
+		if code := exitCode(err); code != test.code {
+			t.Errorf("%v: expected exit code (%v) got (%v): %v", i, test.code, code, err)
+		}
+		if test.pid > 0 && !strings.Contains(out, fmt.Sprintf("pid %d, running for", pid)) {
+			t.Errorf("%v: expected the run in progress to be shown:\n%s", i, out)
+		}
+		if ran := runs()[0] != ""; ran != test.ran {
+			t.Errorf("%v: expected ran=%v got %v", i, test.ran, ran)
+		}
+		done()
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	runs, done := useFakePuppet(t)
+	defer done()
+	if err := ioutil.WriteFile(puppetLockFile, []byte(`{"disabled_message":"\"upgrading\""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FAKE_PUPPET_SLEEP", "1")
+
+	start := time.Now()
+	out, err := capturePat("--nosilence", "--timeout", "200ms", "--once")
+	if code := exitCode(err); code != exitTimeout {
+		t.Errorf("expected exit code (%v) got (%v): %v", exitTimeout, code, err)
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("puppet wasn't stopped; pat took %v", took)
+	}
+	if !strings.Contains(out, "RESULT: TIMED OUT") {
+		t.Errorf("expected the timeout to be reported:\n%s", out)
+	}
+	if r := runs(); len(r) != 3 || r[2] != `agent --disable "upgrading"` {
+		t.Errorf("expected puppet to be disabled again, got runs %q", r)
+	}
+	time.Sleep(1500 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(filepath.Dir(puppetLockFile), "survived")); err == nil {
+		t.Errorf("puppet's children were left running")
+	}
+}
+
+// Without root, puppet's children are found to be stopped through sudo
+func TestDescendants(t *testing.T) {
+	cmd := exec.Command("sh", "-c", "sleep 30 & sleep 30 & wait")
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		for _, pid := range descendants(cmd.Process.Pid) {
+			syscall.Kill(pid, syscall.SIGKILL)
+		}
+		cmd.Process.Kill()
+		cmd.Wait()
+	}()
+	var pids []int
+	for start := time.Now(); len(pids) < 2 && time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		pids = descendants(cmd.Process.Pid)
+	}
+	if len(pids) != 2 {
+		t.Fatalf("expected (%v) descendants got (%v)", 2, pids)
+	}
+	if len(descendants(pids[0])) != 0 {
+		t.Errorf("expected sleep to have no descendants")
+	}
+}
+
+func TestOnceInterrupted(t *testing.T) {
+	runs, done := useFakePuppet(t)
+	defer done()
+	if err := ioutil.WriteFile(puppetLockFile, []byte(`{"disabled_message":"\"upgrading\""}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("FAKE_PUPPET_SLEEP", "5")
+
+	// ^C once puppet is running
+	go func() {
+		for len(runs()) < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+	start := time.Now()
+	out, err := capturePat("--nosilence", "--once")
+	if code := exitCode(err); code != 128+int(syscall.SIGINT) {
+		t.Errorf("expected exit code (%v) got (%v): %v", 128+int(syscall.SIGINT), code, err)
+	}
+	if took := time.Since(start); took > 4*time.Second {
+		t.Errorf("puppet wasn't stopped; pat took %v", took)
+	}
+	if !strings.Contains(out, "RESULT: INTERRUPTED") {
+		t.Errorf("expected the interruption to be reported:\n%s", out)
+	}
+	if r := runs(); len(r) != 3 || r[2] != `agent --disable "upgrading"` {
+		t.Errorf("expected puppet to be disabled again, got runs %q", r)
+	}
+	message, err := getPuppetDisabledMessage()
+	if err != nil || message != `"upgrading"` {
+		t.Errorf("expected puppet to be disabled again with its message, got %q %v", message, err)
+	}
+}
+
+const transientReport = `--- !ruby/object:Puppet::Transaction::Report
+status: failed
+logs:
+- !ruby/object:Puppet::Util::Log
+  level: !ruby/sym err
+  message: 'Could not retrieve catalog from remote server: SSL_connect returned=1 errno=0 state=error'
+  source: Puppet
+`
+
+const failedResourceReport = `--- !ruby/object:Puppet::Transaction::Report
+status: failed
+logs:
+- !ruby/object:Puppet::Util::Log
+  level: !ruby/sym err
+  message: 'Could not retrieve catalog from remote server: SSL_connect returned=1 errno=0 state=error'
+resource_statuses:
+  Package[nginx]: !ruby/object:Puppet::Resource::Status
+    failed: true
+`
+
+func TestRetries(t *testing.T) {
+	tests := []struct {
+		exits  string
+		output string
+		report string
+		args   []string
+		code   int
+		runs   int
+	}{
+		{"1 0", "Error: Could not retrieve catalog from remote server: Error 503 on SERVER: Service Unavailable", "", []string{"--retries", "2"}, exitOK, 2},
+		{"1 1 1", "Error: Could not retrieve catalog from remote server: Error 503 on SERVER", "", []string{"--retries", "2"}, exitError, 3},
+		{"1 2", "", transientReport, []string{"--retries", "1"}, exitChanges, 2},
+		{"1 0", "", failedResourceReport, []string{"--retries", "1"}, exitError, 1},
+		{"1 0", "Error: Could not parse for environment production", "", []string{"--retries", "2"}, exitError, 1},
+		{"4 0", "Error: Could not retrieve catalog from remote server: Error 503 on SERVER", "", []string{"--retries", "2"}, exitFailures, 1},
+		{"1 0", "Error: Could not retrieve catalog from remote server: Error 503 on SERVER", "", nil, exitError, 1},
+	}
+	for i, test := range tests {
+		runs, done := useFakePuppet(t)
+		os.Setenv("FAKE_PUPPET_EXIT", test.exits)
+		os.Setenv("FAKE_PUPPET_OUTPUT", test.output)
+		if test.report != "" {
+			report := filepath.Join(filepath.Dir(puppetLockFile), "report")
+			ioutil.WriteFile(report, []byte(test.report), 0644)
+			os.Setenv("FAKE_PUPPET_REPORT", report)
+		}
+		out, err := capturePat(append([]string{"--retry-delay", "1ms"}, test.args...)...)
+		if code := exitCode(err); code != test.code {
+			t.Errorf("%v: expected exit code (%v) got (%v): %v", i, test.code, code, err)
+		}
+		if r := runs(); len(r) != test.runs {
+			t.Errorf("%v: expected (%v) runs got %q", i, test.runs, r)
+		}
+		if test.runs > 1 && !strings.Contains(out, fmt.Sprintf("ATTEMPT %d of", test.runs)) {
+			t.Errorf("%v: expected the attempts to be logged:\n%s", i, out)
+		}
+		done()
+	}
+}
+
+func TestRunnerOutput(t *testing.T) {
+	_, done := useFakePuppet(t)
+	defer done()
+	//Lots of lines on both streams, a long line, and no newline at the end
+	script := filepath.Join(filepath.Dir(puppetLockFile), "noisy")
+	err := ioutil.WriteFile(script, []byte(`#!/bin/sh
+i=0
+while [ $i -lt 500 ]; do
+	echo "out $i"
+	echo "err $i" >&2
+	i=$((i+1))
+done
+head -c 100000 /dev/zero | tr '\0' x; echo
+printf 'last'
+`), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	puppetBinPath = script
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	printed := make(chan string)
+	go func() {
+		out, _ := ioutil.ReadAll(r)
+		printed <- string(out)
+	}()
+	stdout := os.Stdout
+	os.Stdout = w
+	runner := &execRunner{stderrStyle: "tag"}
+	err = runner.Run(nil)
+	os.Stdout = stdout
+	w.Close()
+	out := <-printed
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := runner.Output()
+	if len(lines) != 1002 {
+		t.Fatalf("expected (%v) lines got (%v)", 1002, len(lines))
+	}
+	next := map[bool]int{}
+	for i, l := range lines {
+		if l.Text == "last" || strings.HasPrefix(l.Text, "xxx") {
+			continue
+		}
+		want := fmt.Sprintf("out %d", next[false])
+		if l.Stderr {
+			want = fmt.Sprintf("err %d", next[true])
+		}
+		if l.Text != want {
+			t.Fatalf("%v: expected (%v) got (%v)", i, want, l.Text)
+		}
+		next[l.Stderr]++
+		if i > 0 && l.Time.Before(lines[i-1].Time) {
+			t.Errorf("%v: out of order: %v is before %v", i, l.Time, lines[i-1].Time)
+		}
+	}
+	for _, want := range []string{"\nout 499\n", "\nstderr: err 499\n", strings.Repeat("x", 100000) + "\n", "\nlast\n"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected (%.40q) in output", want)
+		}
+	}
+	if strings.Contains(out, "stderr: out") {
+		t.Errorf("stdout was tagged as stderr")
+	}
+}
+
+func TestRunnerNoPuppet(t *testing.T) {
+	_, done := useFakePuppet(t)
+	defer done()
+	puppetBinPath = filepath.Join(filepath.Dir(puppetLockFile), "no-such-puppet")
+	runner := &execRunner{}
+	if err := runner.Run(nil); err == nil {
+		t.Fatal("expected an error running a puppet that isn't there")
+	}
+	if out := runner.Output(); len(out) != 0 {
+		t.Errorf("expected no output, got %+v", out)
+	}
+}
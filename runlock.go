@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runLockPoll is how often waitForRun looks at the run lock again.
+var runLockPoll = time.Second
+
+// runLock is puppet's lock on a run that is in progress.
+type runLock struct {
+	PID   int       `json:"pid"`
+	Since time.Time `json:"since"`
+}
+
+// getRunLock returns the lock held by a puppet run in progress, or nil if
+// puppet isn't running. A lock left behind by a puppet that died is ignored,
+// as puppet itself does.
+func getRunLock() (*runLock, error) {
+	contents, err := osReadStateFile(puppetRunLockFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", puppetRunLockFile, err)
+	}
+	if !osProcessRunning(pid) {
+		return nil, nil
+	}
+	l := &runLock{PID: pid}
+	if fi, err := os.Stat(puppetRunLockFile); err == nil {
+		l.Since = fi.ModTime()
+	}
+	return l, nil
+}
+
+func (l *runLock) String() string {
+	if l.Since.IsZero() {
+		return fmt.Sprintf("pid %d", l.PID)
+	}
+	return fmt.Sprintf("pid %d, running for %s", l.PID, shortDuration(time.Since(l.Since)))
+}
+
+// waitForRun waits up to wait for a puppet run that is already in progress
+// to finish, rather than starting a run that puppet would refuse. If it
+// doesn't finish in time, it returns an exitStatus of exitRunInProgress.
+func waitForRun(wait time.Duration) error {
+	l, err := getRunLock()
+	if err != nil || l == nil {
+		return err
+	}
+	tsLn("Puppet is already running:", l)
+	if wait <= 0 {
+		return &exitStatus{code: exitRunInProgress, err: fmt.Errorf("a puppet run is already in progress; use --wait to wait for it")}
+	}
+	tsLn("Waiting up to", wait, "for it to finish")
+	deadline := time.Now().Add(wait)
+	lastProgress := time.Now()
+	for time.Now().Before(deadline) {
+		time.Sleep(runLockPoll)
+		l, err = getRunLock()
+		if err != nil {
+			return err
+		}
+		if l == nil {
+			tsLn("The puppet run in progress has finished")
+			return nil
+		}
+		if time.Since(lastProgress) >= 10*time.Second {
+			tsLn("Still waiting:", l)
+			lastProgress = time.Now()
+		}
+	}
+	return &exitStatus{code: exitRunInProgress, err: fmt.Errorf("gave up after %s waiting for the puppet run in progress (%s)", wait, l)}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	silence "github.com/StackExchange/pat/addsilence"
+	"github.com/StackExchange/pat/version"
+	"github.com/urfave/cli"
+)
+
+// logDir is where each run's log is kept, unless --log-dir says otherwise.
+// Tests change it.
+var logDir = osLogDir
+
+// runLog, if set, gets a timestamped copy of everything printed with tsPrintf and tsLn.
+var runLog io.Writer
+
+// Run logs are named pat-<start time>-<pid>.log, so they sort oldest first.
+const (
+	runLogPrefix     = "pat-"
+	runLogSuffix     = ".log"
+	runLogTimeFormat = "20060102-150405.000000"
+)
+
+// openRunLog starts a log of this run in the --log-dir, and removes old logs
+// so that only --log-keep remain. If the log can't be written the run goes
+// ahead without one.
+func openRunLog(c *cli.Context) (io.WriteCloser, error) {
+	dir := c.GlobalString("log-dir")
+	if dir == "" {
+		return nil, nil
+	}
+	now := time.Now()
+	name := fmt.Sprintf("%s%s-%d%s", runLogPrefix, now.Format(runLogTimeFormat), os.Getpid(), runLogSuffix)
+	f, err := osCreateLogFile(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	user, _ := silence.LoginUser()
+	host, _ := os.Hostname()
+	fmt.Fprintln(f, "# pat run log")
+	fmt.Fprintln(f, "# started:", now.Format(time.RFC3339))
+	fmt.Fprintln(f, "# user:", user)
+	if sudoUser := silence.SudoUser(); sudoUser != "" {
+		fmt.Fprintln(f, "# sudo user:", sudoUser)
+	}
+	fmt.Fprintln(f, "# host:", host)
+	fmt.Fprintln(f, "# version:", version.GetVersionInfo())
+	fmt.Fprintln(f, "# args:", strings.Join(redactArgs(os.Args), " "))
+	pruneRunLogs(dir, c.GlobalInt("log-keep"))
+	return f, nil
+}
+
+// closeRunLog records how the run ended, and stops logging.
+func closeRunLog(f io.WriteCloser, err error) {
+	runLog = nil
+	code, err := exitResult(err)
+	if err != nil {
+		fmt.Fprintf(f, "# exit: %d (%v)\n", code, err)
+	} else {
+		fmt.Fprintf(f, "# exit: %d\n", code)
+	}
+	if err := f.Close(); err != nil {
+		tsLn("WARNING: could not finish this run's log:", err)
+	}
+}
+
+// secretFlags are the flags whose values aren't written to run logs.
+var secretFlags = []string{"silence-token", "silence-password"}
+
+// redactArgs hides secrets given on the command line.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	copy(redacted, args)
+	for i, a := range redacted {
+		name := strings.TrimLeft(a, "-")
+		if name == a {
+			continue
+		}
+		for _, secret := range secretFlags {
+			switch {
+			case strings.HasPrefix(name, secret+"="):
+				redacted[i] = a[:strings.Index(a, "=")+1] + "REDACTED"
+			case name == secret && i+1 < len(redacted):
+				redacted[i+1] = "REDACTED"
+			}
+		}
+	}
+	return redacted
+}
+
+// runLogs lists the run logs in dir, oldest first.
+func runLogs(dir string) ([]string, error) {
+	files, err := osListStateDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if strings.HasPrefix(f, runLogPrefix) && strings.HasSuffix(f, runLogSuffix) {
+			names = append(names, f)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// pruneRunLogs removes all but the newest keep logs. If keep isn't positive,
+// they are all kept.
+func pruneRunLogs(dir string, keep int) {
+	if keep <= 0 {
+		return
+	}
+	names, err := runLogs(dir)
+	if err != nil {
+		tsLn("WARNING: could not remove old logs:", err)
+		return
+	}
+	for len(names) > keep {
+		if err := osRemoveStateFile(filepath.Join(dir, names[0])); err != nil {
+			tsLn("WARNING: could not remove old log:", err)
+		}
+		names = names[1:]
+	}
+}
+
+// readRunLogHeader reads the "# key: value" lines at the start and end of a
+// run log.
+func readRunLogHeader(path string) (map[string]string, error) {
+	contents, err := osReadStateFile(path)
+	if err != nil {
+		return nil, err
+	}
+	header := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(contents))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "# ") {
+			continue
+		}
+		if kv := strings.SplitN(line[2:], ": ", 2); len(kv) == 2 {
+			header[kv[0]] = kv[1]
+		}
+	}
+	return header, scanner.Err()
+}
+
+// CMD: logs [--last] [file]
+func doLogs(c *cli.Context) error {
+	dir := c.GlobalString("log-dir")
+	if dir == "" {
+		return fmt.Errorf("no --log-dir is set, so runs aren't logged")
+	}
+	names, err := runLogs(dir)
+	if err != nil {
+		return err
+	}
+	show := c.Args().First()
+	if c.Bool("last") {
+		if len(names) == 0 {
+			return fmt.Errorf("no runs have been logged in %s", dir)
+		}
+		show = names[len(names)-1]
+	}
+	if show != "" {
+		//Only show logs from the log directory
+		show = filepath.Base(show)
+		if !strings.HasPrefix(show, runLogPrefix) || !strings.HasSuffix(show, runLogSuffix) {
+			return fmt.Errorf("%s isn't a pat run log; see 'pat logs'", show)
+		}
+		contents, err := osReadStateFile(filepath.Join(dir, show))
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(contents)
+		return err
+	}
+
+	if len(names) == 0 {
+		tsLn("No runs have been logged in", dir)
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STARTED\tUSER\tEXIT\tARGS\tFILE")
+	for _, name := range names {
+		h, err := readRunLogHeader(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+		started := h["started"]
+		if t, err := time.Parse(time.RFC3339, started); err == nil {
+			started = t.Local().Format(time.RFC822)
+		}
+		user := h["user"]
+		if h["sudo user"] != "" {
+			user = h["sudo user"]
+		}
+		exit := h["exit"]
+		if exit == "" {
+			exit = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", started, user, exit, h["args"], name)
+	}
+	return w.Flush()
+}
@@ -0,0 +1,86 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestRunLog(t *testing.T) {
+	_, done := useFakePuppet(t)
+	defer done()
+	os.Setenv("FAKE_PUPPET_OUTPUT", "Notice: Applied catalog")
+	os.Setenv("FAKE_PUPPET_EXIT", "2")
+
+	for i := 0; i < 4; i++ {
+		if _, err := capturePat("--nosilence", "--log-keep", "3"); exitCode(err) != exitChanges {
+			t.Fatalf("%v: expected changes, got %v", i, err)
+		}
+	}
+	//--status isn't logged
+	capturePat("--status")
+	names, err := runLogs(logDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 3 {
+		t.Fatalf("expected (%v) logs got (%v): %v", 3, len(names), names)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(logDir, names[2]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := string(contents)
+	for _, want := range []string{
+		`(?m)^# pat run log$`,
+		`(?m)^# user: \S+$`,
+		`(?m)^# version: \S+`,
+		`(?m)^# args: .+$`,
+		`(?m)^\d{4}-\d\d-\d\dT\S+: +Notice: Applied catalog$`,
+		`(?m)^\S+: +RESULT: CHANGES APPLIED$`,
+		`# exit: 2\n$`,
+	} {
+		if !regexp.MustCompile(want).MatchString(log) {
+			t.Errorf("expected %s in log:\n%s", want, log)
+		}
+	}
+
+	out := runPat(t, "logs")
+	if strings.Count(out, "pat-") != 3 || !strings.Contains(out, "STARTED") {
+		t.Errorf("expected 3 logs listed:\n%s", out)
+	}
+	if out := runPat(t, "logs", "--last"); out != log {
+		t.Errorf("expected the latest log, got:\n%s", out)
+	}
+	if out := runPat(t, "logs", names[0]); !strings.Contains(out, "# pat run log") {
+		t.Errorf("expected the oldest log, got:\n%s", out)
+	}
+	if _, err := capturePat("logs", "../pat_disabled.json"); err == nil {
+		t.Errorf("expected only logs to be shown")
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args     []string
+		expected []string
+	}{
+		{[]string{"pat", "--once"}, []string{"pat", "--once"}},
+		{[]string{"pat", "--silence-token", "s3cret", "--once"}, []string{"pat", "--silence-token", "REDACTED", "--once"}},
+		{[]string{"pat", "-silence-token=s3cret"}, []string{"pat", "-silence-token=REDACTED"}},
+		{[]string{"pat", "--silence-user", "bob", "--silence-password", "s3cret"}, []string{"pat", "--silence-user", "bob", "--silence-password", "REDACTED"}},
+		{[]string{"pat", "--disable", "silence-token"}, []string{"pat", "--disable", "silence-token"}},
+	}
+	for i, test := range tests {
+		if got := redactArgs(test.args); !reflect.DeepEqual(got, test.expected) {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.expected, got)
+		}
+	}
+}
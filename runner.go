@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Runner runs puppet.
+type Runner interface {
+	// Run runs puppet with args and waits for it to finish, passing on any
+	// signals that arrive on signals. If puppet fails, the error has an
+	// ExitCode method; errTimeout and an *interruptedError mean it was stopped.
+	Run(signals <-chan os.Signal, args ...string) error
+	// Output returns what puppet printed the last time it was run.
+	Output() []outputLine
+}
+
+// outputLine is a line that puppet printed.
+type outputLine struct {
+	Time   time.Time
+	Stderr bool
+	Text   string
+}
+
+// The ways of showing which lines puppet printed to stderr.
+var stderrStyles = map[string]string{
+	"plain": "%s",
+	"tag":   "stderr: %s",
+	"color": "\x1b[31m%s\x1b[0m",
+}
+
+// exitCoder is the error from a puppet that failed.
+type exitCoder interface {
+	ExitCode() int
+}
+
+// How puppet is run. Tests point these at a fake puppet.
+var (
+	puppetBinPath = osPuppetBinPath
+	makeExec      = osMakeExec
+)
+
+// killGrace is how long puppet has to stop after --timeout before it is killed.
+var killGrace = 10 * time.Second
+
+// errTimeout is returned when puppet is stopped for running past --timeout.
+var errTimeout = errors.New("puppet ran for too long")
+
+// interruptedError is returned when puppet is stopped by a signal pat passed on.
+type interruptedError struct {
+	sig os.Signal
+}
+
+func (e *interruptedError) Error() string {
+	return fmt.Sprintf("puppet was stopped by %v", e.sig)
+}
+
+// execRunner runs the real puppet, printing what it prints.
+type execRunner struct {
+	debug bool
+	// timeout, if set, is how long puppet may run before it is stopped.
+	timeout time.Duration
+	// stderrStyle is how lines from stderr are shown: one of stderrStyles.
+	stderrStyle string
+
+	mu     sync.Mutex
+	output []outputLine
+}
+
+// newRunner makes the Runner that runs puppet. Tests change it.
+var newRunner = func(o *options) Runner {
+	return newExecRunner(o)
+}
+
+func newExecRunner(o *options) *execRunner {
+	return &execRunner{debug: o.Debug, timeout: o.Timeout, stderrStyle: o.StderrStyle}
+}
+
+func (r *execRunner) Run(signals <-chan os.Signal, args ...string) error {
+	if r.debug {
+		tsLn("DEBUG: Invoking", puppetBinPath, "with arguments:", args)
+	}
+
+	//Execute and return
+	cmd, err := makeExec(puppetBinPath, args...)
+	defer osCleanupExec(cmd)
+	if err != nil {
+		return err
+	}
+	if r.debug && cmd.Path != puppetBinPath {
+		tsLn("DEBUG: Running", cmd.Path, cmd.Args[1:])
+	}
+	if r.timeout > 0 {
+		//So that a timeout stops whatever puppet has started, too
+		osNewProcessGroup(cmd)
+	}
+	cmdReaderStd, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	cmdReaderErr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	r.output = nil
+	r.mu.Unlock()
+	//Lines from both pipes go through one channel, so that they are printed
+	//one at a time and in the order they arrive
+	lines := make(chan outputLine)
+	var readers sync.WaitGroup
+	readers.Add(2)
+	go readLines(cmdReaderStd, false, lines, &readers)
+	go readLines(cmdReaderErr, true, lines, &readers)
+	printed := make(chan struct{})
+	go func() {
+		for l := range lines {
+			r.print(l)
+		}
+		close(printed)
+	}()
+
+	err = cmd.Start()
+	if err != nil {
+		//Nothing will be written to the pipes
+		cmdReaderStd.Close()
+		cmdReaderErr.Close()
+		readers.Wait()
+		close(lines)
+		<-printed
+		return err
+	}
+	outputDone := func() {
+		readers.Wait()
+		close(lines)
+		<-printed
+	}
+	return r.wait(cmd, outputDone, signals)
+}
+
+// readLines sends each line read from pipe to lines.
+func readLines(pipe io.Reader, stderr bool, lines chan<- outputLine, readers *sync.WaitGroup) {
+	defer readers.Done()
+	scanner := bufio.NewScanner(pipe)
+	//Puppet's diffs can have long lines
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		lines <- outputLine{Time: time.Now(), Stderr: stderr, Text: scanner.Text()}
+	}
+	//If puppet couldn't be started, the pipes are closed without being written to
+	if err := scanner.Err(); err != nil && !errors.Is(err, os.ErrClosed) {
+		lines <- outputLine{Time: time.Now(), Stderr: true, Text: fmt.Sprintf("pat: could not read puppet's output: %v", err)}
+		//Keep puppet from blocking on a full pipe
+		io.Copy(ioutil.Discard, pipe)
+	}
+}
+
+// print shows a line puppet printed, and keeps it.
+func (r *execRunner) print(l outputLine) {
+	format := "%s"
+	if l.Stderr && stderrStyles[r.stderrStyle] != "" {
+		format = stderrStyles[r.stderrStyle]
+	}
+	tsPrintf(format+"\n", l.Text)
+	r.mu.Lock()
+	r.output = append(r.output, l)
+	r.mu.Unlock()
+}
+
+func (r *execRunner) Output() []outputLine {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]outputLine(nil), r.output...)
+}
+
+// wait waits for puppet to finish, and outputDone to say all its output
+// has been printed. If puppet runs for longer than the timeout, it is
+// stopped, and any signals are passed on. Either way puppet is killed if it
+// doesn't stop within killGrace.
+func (r *execRunner) wait(cmd *exec.Cmd, outputDone func(), signals <-chan os.Signal) error {
+	done := make(chan error, 1)
+	go func() {
+		//Wait must not close the pipes before everything has been read from them
+		outputDone()
+		done <- cmd.Wait()
+	}()
+	ctx := context.Background()
+	if r.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.timeout)
+		defer cancel()
+	}
+	var stopped error
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		tsLn("Puppet has run for longer than", r.timeout, "- stopping it")
+		if err := osStopPuppet(cmd, false); err != nil {
+			tsLn("WARNING: Could not stop puppet:", err)
+		}
+		stopped = errTimeout
+	case sig := <-signals:
+		tsLn("Got", sig, "- passing it on to puppet and waiting for it to stop")
+		if err := osSignalPuppet(cmd, sig); err != nil {
+			tsLn("WARNING: Could not signal puppet:", err)
+		}
+		stopped = &interruptedError{sig: sig}
+	}
+	select {
+	case <-done:
+	case <-time.After(killGrace):
+		tsLn("Puppet hasn't stopped - killing it")
+		if err := osStopPuppet(cmd, true); err != nil {
+			tsLn("WARNING: Could not kill puppet:", err)
+		}
+		select {
+		case <-done:
+		case <-time.After(killGrace):
+			//Something puppet started still has its output open
+			tsLn("WARNING: Gave up waiting for puppet to exit")
+		}
+	}
+	return stopped
+}
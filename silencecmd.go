@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	silence "github.com/StackExchange/pat/addsilence"
+	"github.com/urfave/cli"
+)
+
+// CMD: silence list
+func doSilenceList(c *cli.Context) error {
+	silences, mine, err := hostSilences(c)
+	if err != nil {
+		return err
+	}
+	if len(silences) == 0 {
+		tsLn("No silences on this host")
+		return nil
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SCOPE\tSTART\tEND\tALERT\tTAGS\tUSER\tMESSAGE")
+	wider := false
+	for _, s := range silences {
+		alert := s.Alert
+		if alert == "" {
+			alert = "(all)"
+		}
+		scope := "host"
+		if !mine[s.ID] {
+			scope, wider = "wider", true
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", scope, s.Start.Local().Format(time.RFC822), s.End.Local().Format(time.RFC822), alert, s.TagString, s.User, s.Message)
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if wider {
+		tsLn("Silences marked wider also cover other hosts, so pat silence extend and clear leave them alone")
+	}
+	return nil
+}
+
+// CMD: silence extend <duration>
+func doSilenceExtend(c *cli.Context) error {
+	if c.NArg() == 0 {
+		return fmt.Errorf("usage: pat silence extend <duration>")
+	}
+	// Allow "extend until 17:00" without quotes
+	duration := strings.Join(c.Args(), " ")
+	silences, mine, err := hostSilences(c)
+	if err != nil {
+		return err
+	}
+	if len(mine) == 0 {
+		tsLn("No silences on this host to extend")
+	}
+	ids, err := getSilenceIDs()
+	if err != nil {
+		return err
+	}
+	for _, s := range silences {
+		if !mine[s.ID] {
+			tsLn("Not extending silence", s.ID, s.TagString+", which also covers other hosts")
+			continue
+		}
+		end, err := silence.ParseEnd(duration, s.End)
+		if err != nil {
+			return err
+		}
+		oldID := s.ID
+		summary, err := silence.ExtendSilence(s, end)
+		if err != nil {
+			return err
+		}
+		tsLn(summary)
+		// Keep track of the silences pat set, so pat enable still clears them.
+		for i := range ids {
+			if ids[i] == oldID && s.ID != "" {
+				ids[i] = s.ID
+			}
+		}
+	}
+	return putSilenceIDs(ids)
+}
+
+// CMD: silence clear
+func doSilenceClear(c *cli.Context) error {
+	silences, mine, err := hostSilences(c)
+	if err != nil {
+		return err
+	}
+	if len(mine) == 0 {
+		tsLn("No silences on this host to clear")
+	}
+	for _, s := range silences {
+		if !mine[s.ID] {
+			tsLn("Not clearing silence", s.ID, s.TagString+", which also covers other hosts")
+			continue
+		}
+		if err := silence.ClearSilence("", s.ID); err != nil {
+			return err
+		}
+		tsLn("Cleared silence:", s.ID, s.Alert, s.TagString)
+	}
+	return putSilenceIDs(nil)
+}
+
+// Get the active and pending silences on any of this host's names, and the
+// IDs of those that pat may extend or clear: the ones it recorded setting,
+// and any on nothing but this host's names. The rest also cover other hosts
+// (host=web*, or host=web01|db01), so are left to whoever set them.
+func hostSilences(c *cli.Context) ([]*silence.Silence, map[string]bool, error) {
+	hosts, _, err := setupSilencer(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	ids, err := getSilenceIDs()
+	if err != nil {
+		return nil, nil, err
+	}
+	mine := map[string]bool{}
+	for _, id := range ids {
+		mine[id] = true
+	}
+	var silences []*silence.Silence
+	seen := map[string]bool{}
+	for _, h := range hosts {
+		found, err := silence.ListSilences(silence.HostTags([]string{h}))
+		if err == silence.ErrNotSupported {
+			return nil, nil, fmt.Errorf("this silencer can't list silences")
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, s := range found {
+			if !seen[s.ID] {
+				seen[s.ID] = true
+				silences = append(silences, s)
+			}
+		}
+	}
+	for id := range mine {
+		if !seen[id] {
+			delete(mine, id)
+		}
+	}
+	for _, s := range silences {
+		if silence.OnlyHosts(s.TagString, hosts) {
+			mine[s.ID] = true
+		}
+	}
+	return silences, mine, nil
+}
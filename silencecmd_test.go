@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	silence "github.com/StackExchange/pat/addsilence"
+)
+
+// runPat runs pat with args, returning what it printed.
+func runPat(t *testing.T, args ...string) string {
+	out, err := capturePat(args...)
+	if err != nil {
+		t.Fatalf("pat %v: %v", args, err)
+	}
+	return out
+}
+
+// capturePat runs pat with args, as main does, returning what it printed and
+// its error.
+func capturePat(args ...string) (string, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	pat := newApp()
+	args, _ = legacyArgs(append([]string{"pat"}, args...), boolFlagNames(pat.Flags))
+	err = pat.Run(args)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	return string(out), err
+}
+
+func TestSilenceCommand(t *testing.T) {
+	f, done := startFakeBosun(t)
+	defer done()
+
+	host := silence.HostTags(nil)
+	start := time.Now().UTC().Truncate(time.Second)
+	end := start.Add(time.Hour)
+	// pat's own silence, recorded, and one on nothing but this host
+	f.silences["mine"] = &silence.Silence{Start: start, End: end, Alert: silenceAlert, TagString: host + ",role=web", User: "alice", Message: "upgrading"}
+	f.silences["plain"] = &silence.Silence{Start: start, End: end, TagString: host, User: "dave", Message: "reboot"}
+	// Silences wider than this host are only listed
+	f.silences["wild"] = &silence.Silence{Start: start, End: end, TagString: host[:len(host)-1] + "*|db01", User: "bob", Message: "rack move"}
+	f.silences["other"] = &silence.Silence{Start: start, End: end, Alert: silenceAlert, TagString: "host=elsewhere", User: "carol"}
+	if err := putSilenceIDs([]string{"mine"}); err != nil {
+		t.Fatal(err)
+	}
+
+	out := runPat(t, "silence", "list")
+	for _, want := range []string{"alice", "upgrading", silenceAlert, "bob", "rack move", "(all)", "dave", "wider"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("list output lacks %q:\n%s", want, out)
+		}
+	}
+	if strings.Contains(out, "carol") {
+		t.Errorf("list output includes another host's silence:\n%s", out)
+	}
+
+	runPat(t, "silence", "extend", "2h")
+	if len(f.requests) != 2 {
+		t.Fatalf("expected 2 silences to be replaced, got %d: %+v", len(f.requests), f.requests)
+	}
+	for _, r := range f.requests {
+		if r.End != end.Add(2*time.Hour).Format("2006-01-02 15:04:05 MST") || r.Edit == "" {
+			t.Errorf("unexpected extension %+v", r)
+		}
+	}
+	if f.silences["other"] == nil || f.silences["wild"] == nil || f.silences["wild"].End != end || len(f.silences) != 4 {
+		t.Errorf("unexpected silences after extend: %v", f.silences)
+	}
+	ids, err := getSilenceIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 1 || ids[0] == "mine" || f.silences[ids[0]] == nil || f.silences[ids[0]].Message != "upgrading" {
+		t.Errorf("recorded silence ID not updated: %v", ids)
+	}
+
+	runPat(t, "silence", "clear")
+	if f.silences["other"] == nil || f.silences["wild"] == nil || len(f.silences) != 2 {
+		t.Errorf("unexpected silences after clear: %v", f.silences)
+	}
+	if _, err := os.Stat(patDisableFile); !os.IsNotExist(err) {
+		t.Errorf("expected %s to be removed, got %v", patDisableFile, err)
+	}
+}
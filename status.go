@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// patStatus is what pat status reports.
+type patStatus struct {
+	// State is enabled, disabled or unknown.
+	State          string          `json:"state"`
+	Disabled       bool            `json:"disabled"`
+	Message        string          `json:"message,omitempty"`
+	LockModified   *time.Time      `json:"lock_modified,omitempty"`
+	DisabledBy     *disableRecord  `json:"disabled_by,omitempty"`
+	LastRun        *time.Time      `json:"last_run,omitempty"`
+	LastRunResult  string          `json:"last_run_result,omitempty"`
+	LastRunSummary *lastRunSummary `json:"last_run_summary,omitempty"`
+	Running        *runLock        `json:"running,omitempty"`
+	Server         string          `json:"server,omitempty"`
+	Errors         []string        `json:"errors,omitempty"`
+}
+
+// doStatus reports whether puppet is disabled, and how its last run went, as
+// text or json. The exit code says whether puppet is enabled, disabled or unknown.
+func doStatus(format string) error {
+	if format != "text" && format != "json" {
+		return fmt.Errorf("unknown --format %q: use text or json", format)
+	}
+	st := getStatus()
+	if format == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(st); err != nil {
+			return err
+		}
+	} else {
+		printStatus(st)
+	}
+	switch st.State {
+	case "disabled":
+		return &exitStatus{code: exitDisabled}
+	case "unknown":
+		return &exitStatus{code: exitUnknown}
+	}
+	return nil
+}
+
+func getStatus() *patStatus {
+	st := &patStatus{State: "enabled", Server: puppetServer}
+	contents, err := osReadStateFile(puppetLockFile)
+	if err != nil && !os.IsNotExist(err) {
+		st.State = "unknown"
+		st.Errors = append(st.Errors, err.Error())
+	}
+	if err == nil {
+		st.State, st.Disabled = "disabled", true
+		var m disabledMessage
+		if err := json.Unmarshal(contents, &m); err != nil {
+			st.Errors = append(st.Errors, fmt.Sprintf("%s: %v", puppetLockFile, err))
+		}
+		st.Message = m.DisabledMessage
+		if fi, err := os.Stat(puppetLockFile); err == nil {
+			mtime := fi.ModTime()
+			st.LockModified = &mtime
+		}
+		record, err := getDisableRecord()
+		if err != nil {
+			st.Errors = append(st.Errors, err.Error())
+		} else if record.matches(st.Message) {
+			st.DisabledBy = record
+		}
+	}
+
+	st.Running, err = getRunLock()
+	if err != nil {
+		st.Errors = append(st.Errors, err.Error())
+	}
+
+	summary, err := getLastRunSummary()
+	if err != nil {
+		st.Errors = append(st.Errors, err.Error())
+	}
+	if summary != nil && summary.Time.LastRun != 0 {
+		lastRun := time.Unix(summary.Time.LastRun, 0)
+		st.LastRun = &lastRun
+		st.LastRunResult = summary.result()
+		st.LastRunSummary = summary
+	}
+	return st
+}
+
+func printStatus(st *patStatus) {
+	switch st.State {
+	case "disabled":
+		tsLn("STATUS: PUPPET IS DISABLED")
+		tsLn("DISABLE MESSAGE: ", st.Message)
+		if st.DisabledBy != nil {
+			tsLn("DISABLED BY: ", st.DisabledBy.describe(time.Now()))
+		}
+	case "enabled":
+		tsLn("STATUS: PUPPET IS ENABLED")
+	default:
+		tsLn("STATUS: UNKNOWN")
+	}
+	if st.LastRun != nil {
+		tsLn("LAST RUN: ", st.LastRun.Format("2006-01-02 15:04:05 MST"), strings.ToUpper(st.LastRunResult))
+		tsLn("SUMMARY: ", st.LastRunSummary.describe())
+	}
+	if st.Running != nil {
+		tsLn("RUN IN PROGRESS: ", st.Running)
+	}
+	if st.Server != "" {
+		tsLn("PUPPET SERVER: ", st.Server)
+	}
+	for _, e := range st.Errors {
+		tsLn("WARNING:", e)
+	}
+}
+
+// getLastRunSummary reads puppet's summary of its last run, or returns nil if
+// there isn't one.
+func getLastRunSummary() (*lastRunSummary, error) {
+	contents, err := osReadStateFile(puppetLastRunFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var s lastRunSummary
+	if err := yaml.Unmarshal(contents, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", puppetLastRunFile, err)
+	}
+	return &s, nil
+}
+
+// showLastRun prints the summary of the puppet run that started at since, if
+// puppet got as far as writing one.
+func showLastRun(since time.Time) {
+	s, err := getLastRunSummary()
+	if err != nil {
+		tsLn("WARNING: Could not read the run summary:", err)
+		return
+	}
+	if s == nil || time.Unix(s.Time.LastRun, 0).Before(since.Truncate(time.Second)) {
+		return
+	}
+	tsLn("SUMMARY:", strings.ToUpper(s.result())+":", s.describe())
+}
+
+// describe sums the run up on one line, e.g. "2 changed, 0 failed, 2 out of
+// sync, 1 restarted in 23.5s, config 1709635680, environment production".
+func (s *lastRunSummary) describe() string {
+	var parts []string
+	if s.Resources != nil {
+		r := s.Resources
+		parts = append(parts, fmt.Sprintf("%d changed, %d failed, %d out of sync, %d restarted in %.1fs",
+			r.Changed, r.Failed+r.FailedToRestart, r.OutOfSync, r.Restarted, s.Time.Total))
+	} else {
+		parts = append(parts, "no catalog applied")
+	}
+	if s.Version.Config != "" {
+		parts = append(parts, "config "+s.Version.Config)
+	}
+	env := s.Application.ConvergedEnvironment
+	if env == "" {
+		env = s.Application.InitialEnvironment
+	}
+	if env != "" {
+		parts = append(parts, "environment "+env)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// result is failed, changed or unchanged.
+func (s *lastRunSummary) result() string {
+	if s.Resources == nil || s.Events == nil {
+		return "failed"
+	}
+	if s.Resources.Failed > 0 || s.Resources.FailedToRestart > 0 || s.Events.Failure > 0 {
+		return "failed"
+	}
+	if s.Resources.Changed > 0 {
+		return "changed"
+	}
+	return "unchanged"
+}
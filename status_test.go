@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const changedSummary = `---
+version:
+  config: 1709635680
+  puppet: 7.28.0
+application:
+  run_mode: agent
+  initial_environment: production
+  converged_environment: production
+resources:
+  changed: 2
+  failed: 0
+  failed_to_restart: 0
+  out_of_sync: 2
+  restarted: 1
+  total: 412
+time:
+  total: 23.51
+  last_run: 1709635703
+changes:
+  total: 2
+events:
+  failure: 0
+  success: 2
+  total: 2
+`
+
+func TestLastRunResult(t *testing.T) {
+	tests := []struct {
+		summary  lastRunSummary
+		expected string
+	}{
+		{lastRunSummary{Resources: &summaryResources{}, Events: &summaryEvents{}}, "unchanged"},
+		{lastRunSummary{Resources: &summaryResources{Changed: 3}, Events: &summaryEvents{}}, "changed"},
+		{lastRunSummary{Resources: &summaryResources{Changed: 3, Failed: 1}, Events: &summaryEvents{}}, "failed"},
+		{lastRunSummary{Resources: &summaryResources{}, Events: &summaryEvents{Failure: 1}}, "failed"},
+		{lastRunSummary{}, "failed"},
+	}
+	for i, test := range tests {
+		if got := test.summary.result(); got != test.expected {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.expected, got)
+		}
+	}
+}
+
+func TestDescribeLastRun(t *testing.T) {
+	var changed lastRunSummary
+	if err := yaml.Unmarshal([]byte(changedSummary), &changed); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		summary  lastRunSummary
+		expected string
+	}{
+		{changed, "2 changed, 0 failed, 2 out of sync, 1 restarted in 23.5s, config 1709635680, environment production"},
+		{lastRunSummary{Resources: &summaryResources{Failed: 1, FailedToRestart: 1}, Application: summaryApplication{InitialEnvironment: "test"}},
+			"0 changed, 2 failed, 0 out of sync, 0 restarted in 0.0s, environment test"},
+		{lastRunSummary{Version: summaryVersion{Config: "abc123"}}, "no catalog applied, config abc123"},
+	}
+	for i, test := range tests {
+		if got := test.summary.describe(); got != test.expected {
+			t.Errorf("%v: expected (%v) got (%v)", i, test.expected, got)
+		}
+	}
+}
+
+func TestStatus(t *testing.T) {
+	_, done := useStateDir(t)
+	defer done()
+	if err := ioutil.WriteFile(puppetLastRunFile, []byte(changedSummary), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		lock     string
+		state    string
+		code     int
+		messages []string
+	}{
+		{"", "enabled", exitOK, []string{"PUPPET IS ENABLED", "CHANGED", "2 changed", "environment production"}},
+		{`{"disabled_message":"\"upgrading\""}`, "disabled", exitDisabled, []string{"PUPPET IS DISABLED", "upgrading", "alice", "OPS-1"}},
+		// A directory can't be read, so there's no telling whether puppet is disabled.
+		{"dir", "unknown", exitUnknown, []string{"UNKNOWN", "WARNING"}},
+	}
+	record := &disableRecord{Message: "upgrading", User: "alice", DisabledAt: time.Now().UTC().Truncate(time.Second), Ticket: "OPS-1"}
+	if err := putDisableRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	for i, test := range tests {
+		os.RemoveAll(puppetLockFile)
+		switch test.lock {
+		case "":
+		case "dir":
+			os.Mkdir(puppetLockFile, 0755)
+		default:
+			ioutil.WriteFile(puppetLockFile, []byte(test.lock), 0644)
+		}
+
+		out, err := capturePat("--status")
+		if code := exitCode(err); code != test.code {
+			t.Errorf("%v: expected exit code (%v) got (%v): %v", i, test.code, code, err)
+		}
+		for _, m := range test.messages {
+			if !strings.Contains(out, m) {
+				t.Errorf("%v: output lacks %q:\n%s", i, m, out)
+			}
+		}
+
+		out, err = capturePat("--status", "--format", "json")
+		if code := exitCode(err); code != test.code {
+			t.Errorf("%v: expected exit code (%v) got (%v): %v", i, test.code, code, err)
+		}
+		var st patStatus
+		if err := json.Unmarshal([]byte(out), &st); err != nil {
+			t.Errorf("%v: bad json %v:\n%s", i, err, out)
+			continue
+		}
+		if st.State != test.state || st.Disabled != (test.state == "disabled") {
+			t.Errorf("%v: expected state (%v) got (%v)", i, test.state, st.State)
+		}
+		if st.LastRun == nil || st.LastRun.Unix() != 1709635703 || st.LastRunResult != "changed" || st.LastRunSummary == nil || st.LastRunSummary.Version.Config != "1709635680" {
+			t.Errorf("%v: unexpected last run %v %v", i, st.LastRun, st.LastRunResult)
+		}
+		if test.state == "disabled" && (st.Message != `"upgrading"` || st.LockModified == nil || st.DisabledBy == nil || st.DisabledBy.User != "alice") {
+			t.Errorf("%v: unexpected disable details %+v", i, st)
+		}
+	}
+}
+
+// exitCode is the code pat would exit with after returning err.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+	if e, ok := err.(*exitStatus); ok {
+		return e.code
+	}
+	return exitError
+}